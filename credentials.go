@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A credentialStore keeps the API key for each profile outside of the config
+// file. Gateway passwords are kept in it too, under gatewayCredential names.
+type credentialStore interface {
+	Get(profile string) (string, error)
+	Set(profile, apiKey string) error
+	Delete(profile string) error
+}
+
+// getCredentialStore returns the store selected by the CredentialStore option.
+func getCredentialStore() credentialStore {
+	if strings.ToLower(config.CredentialStore) == "command" {
+		return commandStore{command: config.CredentialCommand}
+	}
+	return fileStore{file: path.Join(workflow.DataDir(), "credentials.enc")}
+}
+
+// loadCredentials fills in the API key of each profile from the credential
+// store. Keys still stored in plaintext in the config by older versions are
+// moved into the store, and the config is re-saved without them.
+func loadCredentials() {
+	store := getCredentialStore()
+	migrated := false
+
+	for i := range config.Profiles {
+		p := &config.Profiles[i]
+
+		if loadCredential(store, p.Name, "API key", &p.APIKey) {
+			migrated = true
+		}
+		if p.GatewayUser != "" && loadCredential(store, gatewayCredential(p.Name), "gateway password", &p.GatewayPassword) {
+			migrated = true
+		}
+	}
+
+	if p, ok := getProfile(config.Profile); ok {
+		config.APIKey = p.APIKey
+
+		// a gateway password that was just entered in the options replaces
+		// the stored one when the config is saved
+		if config.GatewayPassword == "" {
+			config.GatewayPassword = p.GatewayPassword
+		}
+	}
+
+	if migrated {
+		if err := saveConfig(); err != nil {
+			log.Println("Error saving config:", err)
+		}
+	}
+}
+
+// loadCredential fills in a secret from the credential store, or moves it
+// into the store if it was saved in the config. It returns true if the secret
+// was moved.
+func loadCredential(store credentialStore, name, what string, value *string) (moved bool) {
+	if *value != "" {
+		if err := store.Set(name, *value); err != nil {
+			log.Printf("Error storing %s for %s: %v", what, name, err)
+		} else {
+			log.Printf("Moved %s for %s to credential store", what, name)
+			moved = true
+		}
+	} else {
+		var err error
+		if *value, err = store.Get(name); err != nil {
+			log.Printf("Error loading %s for %s: %v", what, name, err)
+		}
+	}
+
+	addSecret(*value)
+	return
+}
+
+// gatewayCredential returns the name a profile's gateway password is stored
+// under.
+func gatewayCredential(profile string) string {
+	return profile + gatewaySuffix
+}
+
+const gatewaySuffix = "/gateway"
+
+// fileStore keeps API keys in a file encrypted with AES-GCM. The key is
+// derived from the ALFRED_REDMINE_SECRET environment variable if it's set, or
+// from the machine's hardware UUID otherwise.
+type fileStore struct {
+	file string
+}
+
+func (s fileStore) Get(profile string) (string, error) {
+	keys, err := s.load()
+	if err != nil {
+		return "", err
+	}
+	return keys[profile], nil
+}
+
+func (s fileStore) Set(profile, apiKey string) error {
+	return s.update(func(keys map[string]string) { keys[profile] = apiKey })
+}
+
+func (s fileStore) Delete(profile string) error {
+	return s.update(func(keys map[string]string) { delete(keys, profile) })
+}
+
+// update changes the saved keys while holding a lock on the file, so that
+// copies of the workflow running at the same time don't lose each other's
+// changes.
+func (s fileStore) update(change func(keys map[string]string)) error {
+	lock, err := os.OpenFile(s.file+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	keys, err := s.load()
+	if err != nil {
+		return err
+	}
+	change(keys)
+	return s.save(keys)
+}
+
+func (s fileStore) load() (keys map[string]string, err error) {
+	keys = map[string]string{}
+
+	var data []byte
+	if data, err = ioutil.ReadFile(s.file); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	var gcm cipher.AEAD
+	if gcm, err = s.cipher(); err != nil {
+		return
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return keys, fmt.Errorf("Credential file is corrupt")
+	}
+
+	var plain []byte
+	nonce := data[:gcm.NonceSize()]
+	if plain, err = gcm.Open(nil, nonce, data[gcm.NonceSize():], nil); err != nil {
+		return keys, fmt.Errorf("Unable to decrypt credentials: %v", err)
+	}
+
+	err = json.Unmarshal(plain, &keys)
+	return
+}
+
+func (s fileStore) save(keys map[string]string) error {
+	plain, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := s.cipher()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	// write to a temporary file and move it into place so that the file is
+	// never seen half written
+	f, err := ioutil.TempFile(path.Dir(s.file), path.Base(s.file)+".")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(gcm.Seal(nonce, nonce, plain, nil)); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s fileStore) cipher() (cipher.AEAD, error) {
+	secret, err := getStoreSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	key := sha256.Sum256([]byte("alfred-redmine credentials:" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var platformUUID = regexp.MustCompile(`"IOPlatformUUID"\s*=\s*"([^"]+)"`)
+
+// storeSecret holds the secret once it has been found, since finding the
+// hardware UUID means running ioreg
+var storeSecret struct {
+	sync.Once
+	value string
+	err   error
+}
+
+func getStoreSecret() (string, error) {
+	storeSecret.Do(func() {
+		storeSecret.value, storeSecret.err = findStoreSecret()
+	})
+	return storeSecret.value, storeSecret.err
+}
+
+func findStoreSecret() (string, error) {
+	if secret := os.Getenv("ALFRED_REDMINE_SECRET"); secret != "" {
+		return secret, nil
+	}
+
+	out, err := exec.Command("ioreg", "-rd1", "-c", "IOPlatformExpertDevice").Output()
+	if err == nil {
+		if m := platformUUID.FindSubmatch(out); m != nil {
+			return string(m[1]), nil
+		}
+	}
+
+	// not on a Mac; fall back to something specific to this user and host
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return u.Uid + "@" + host, nil
+}
+
+// commandStore gets API keys from the REDMINE_API_KEY environment variable,
+// or by running a user-configured command such as "pass show redmine". The
+// command is run by the shell with REDMINE_PROFILE set to the profile name,
+// and the first line it prints is used as the key. Keys can't be saved
+// through this store; they have to be added wherever the command reads them.
+// Gateway passwords are read the same way, from REDMINE_GATEWAY_PASSWORD or
+// with REDMINE_PROFILE set to the profile name followed by "/gateway".
+type commandStore struct {
+	command string
+}
+
+func (s commandStore) Get(profile string) (string, error) {
+	envVar := "REDMINE_API_KEY"
+	if strings.HasSuffix(profile, gatewaySuffix) {
+		envVar = "REDMINE_GATEWAY_PASSWORD"
+	}
+	if key := os.Getenv(envVar); key != "" {
+		return key, nil
+	}
+
+	if s.command == "" {
+		return "", fmt.Errorf("No credential command is configured")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", s.command)
+	cmd.Env = append(os.Environ(), "REDMINE_PROFILE="+profile)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Credential command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0]), nil
+}
+
+func (s commandStore) Set(profile, apiKey string) error {
+	if key, err := s.Get(profile); err == nil && key == apiKey {
+		return nil
+	}
+	return fmt.Errorf("The API key for %s must be stored where the credential command can read it", profile)
+}
+
+func (s commandStore) Delete(profile string) error {
+	return nil
+}
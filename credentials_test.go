@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFileStoreConcurrentSets(t *testing.T) {
+	os.Setenv("ALFRED_REDMINE_SECRET", "test secret")
+	defer os.Unsetenv("ALFRED_REDMINE_SECRET")
+
+	// each copy of the workflow saves the key for its own profile
+	store := fileStore{file: filepath.Join(t.TempDir(), "credentials.enc")}
+	const copies = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, copies)
+	for i := 0; i < copies; i++ {
+		wg.Add(1)
+		go func(profile string) {
+			defer wg.Done()
+			errs <- store.Set(profile, "key for "+profile)
+		}(fmt.Sprint("profile", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < copies; i++ {
+		profile := fmt.Sprint("profile", i)
+		if key, err := store.Get(profile); err != nil || key != "key for "+profile {
+			t.Errorf("got key %q (%v) for %s", key, err, profile)
+		}
+	}
+
+	if err := store.Delete("profile0"); err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := store.Get("profile0"); key != "" {
+		t.Errorf("deleted key is still saved: %q", key)
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jason0x43/go-alfred"
@@ -20,13 +23,13 @@ func (c IssuesCommand) About() alfred.CommandDef {
 	return alfred.CommandDef{
 		Keyword:     issuesKeyword,
 		Description: "List your assigned issues",
-		IsEnabled:   config.APIKey != "",
+		IsEnabled:   isLoggedIn(),
 		Mods: map[alfred.ModKey]alfred.ItemMod{
 			alfred.ModCmd: alfred.ItemMod{
 				Arg: &alfred.ItemArg{
 					Keyword: issuesKeyword,
 					Mode:    alfred.ModeDo,
-					Data:    alfred.Stringify(&issueCfg{ToOpen: getMyIssuesURL()}),
+					Data:    stringifyIssueCfg(issueCfg{ToOpen: getMyIssuesURL()}),
 				},
 			},
 		},
@@ -42,23 +45,46 @@ func (c IssuesCommand) Items(arg, data string) (items []alfred.Item, err error)
 		}
 	}
 
-	if err = checkRefresh(); err != nil {
+	if cfg.Profile != "" && cfg.Profile != config.Profile {
+		// the item came from another profile's merged issue list
+		err = withProfile(cfg.Profile, func() (err error) {
+			items, err = c.Items(arg, data)
+			return
+		})
 		return
 	}
 
+	if err = checkRefresh(resUser, resStatuses, resProjects, resIssues); err != nil {
+		return
+	}
+	defer func() { items = append(cacheStatusItems(arg), items...) }()
+
 	pid := -1
 	if cfg.ProjectID != nil {
 		pid = *cfg.ProjectID
 	}
 
 	if cfg.IssueID != nil {
-		var idx int
-		if idx = indexOfByID(issueList(cache.Issues), *cfg.IssueID); idx == -1 {
-			err = fmt.Errorf("Invalid issue ID %d", *cfg.IssueID)
-			return
+		issue, ok := findIssue(*cfg.IssueID)
+		if !ok {
+			// issues listed live (e.g., all of a project's issues) aren't
+			// cached, so load them on demand
+			session := openSession()
+			if issue, err = session.GetIssueContext(commandCtx, *cfg.IssueID); err != nil {
+				if isTimeout(err) {
+					err = errServerSlow
+				} else {
+					err = fmt.Errorf("Invalid issue ID %d", *cfg.IssueID)
+				}
+				return
+			}
+
+			cache.RelatedIssues = append(cache.RelatedIssues, issue)
+			if err := saveCache(); err != nil {
+				log.Printf("Error saving cache: %v\n", err)
+			}
 		}
 
-		issue := cache.Issues[idx]
 		parts := alfred.CleanSplitN(arg, " ", 2)
 
 		if alfred.FuzzyMatches("subject:", parts[0]) {
@@ -67,6 +93,86 @@ func (c IssuesCommand) Items(arg, data string) (items []alfred.Item, err error)
 			})
 		}
 
+		if alfred.FuzzyMatches("progress:", parts[0]) {
+			item := alfred.Item{
+				Title: fmt.Sprintf("Progress: %d%%", getTotalDoneRatio(issue)),
+			}
+			if subtasks := getSubtasks(issue); len(subtasks) > 0 {
+				item.Subtitle = fmt.Sprintf("Including %d subtasks", len(subtasks))
+			}
+			items = append(items, item)
+		}
+
+		if alfred.FuzzyMatches("spent time:", parts[0]) {
+			item := alfred.Item{
+				Title: fmt.Sprintf("Spent time: %.2f hours", getTotalSpentHours(issue)),
+			}
+			if issue.SpentHours != getTotalSpentHours(issue) {
+				item.Subtitle = fmt.Sprintf("%.2f hours on this issue, the rest on subtasks", issue.SpentHours)
+			}
+			items = append(items, item)
+		}
+
+		if issue.Parent.ID != 0 && alfred.FuzzyMatches("parent:", parts[0]) {
+			parentID := issue.Parent.ID
+			item := alfred.Item{
+				Title: fmt.Sprintf("Parent: #%d", parentID),
+				Arg: &alfred.ItemArg{
+					Keyword: issuesKeyword,
+					Data:    stringifyIssueCfg(issueCfg{IssueID: &parentID}),
+				},
+			}
+			if parent, ok := findIssue(parentID); ok {
+				item.Title += " " + parent.Subject
+			}
+			if chain := getParentChain(issue); len(chain) > 1 {
+				item.Subtitle = strings.Join(chain, " › ")
+			}
+			items = append(items, item)
+		}
+
+		if parts[0] != "Subtask:" && alfred.FuzzyMatches("subtasks:", parts[0]) {
+			for _, subtask := range getSubtasks(issue) {
+				subtaskID := subtask.ID
+				items = append(items, alfred.Item{
+					Title:    fmt.Sprintf("Subtask: #%d %s", subtask.ID, subtask.Subject),
+					Subtitle: fmt.Sprintf("%s, %d%% done", subtask.Status.Name, getTotalDoneRatio(subtask)),
+					Arg: &alfred.ItemArg{
+						Keyword: issuesKeyword,
+						Data:    stringifyIssueCfg(issueCfg{IssueID: &subtaskID}),
+					},
+				})
+			}
+		}
+
+		if alfred.FuzzyMatches("subtask:", parts[0]) {
+			if parts[0] == "Subtask:" && len(parts) == 2 {
+				items = append(items, alfred.Item{
+					Title:    "Create subtask: " + parts[1],
+					Subtitle: fmt.Sprintf("Create a %s in %s under issue %d", issue.Tracker.Name, issue.Project.Name, issue.ID),
+					Arg: &alfred.ItemArg{
+						Keyword: issuesKeyword,
+						Mode:    alfred.ModeDo,
+						Data: stringifyIssueCfg(issueCfg{
+							ToCreate: &UpdateIssue{
+								Project:        issue.Project.ID,
+								Tracker:        issue.Tracker.ID,
+								ParentIssue:    issue.ID,
+								Subject:        parts[1],
+								WatcherUserIDs: []int{cache.User.ID},
+							},
+						}),
+					},
+				})
+			} else {
+				items = append(items, alfred.Item{
+					Title:        "Subtask: create a subtask",
+					Subtitle:     "Type the subject of the new subtask",
+					Autocomplete: "Subtask: ",
+				})
+			}
+		}
+
 		if alfred.FuzzyMatches("status:", parts[0]) {
 
 			if parts[0] == "Status:" {
@@ -77,7 +183,7 @@ func (c IssuesCommand) Items(arg, data string) (items []alfred.Item, err error)
 							Arg: &alfred.ItemArg{
 								Keyword: issuesKeyword,
 								Mode:    alfred.ModeDo,
-								Data: alfred.Stringify(&issueCfg{
+								Data: stringifyIssueCfg(issueCfg{
 									ToUpdate: &updateIssueMessage{
 										ID:    issue.ID,
 										Issue: UpdateIssue{Status: st.ID},
@@ -96,17 +202,191 @@ func (c IssuesCommand) Items(arg, data string) (items []alfred.Item, err error)
 				})
 			}
 		}
-	} else {
-		closed := getClosedStatusIDs()
-		var issues []Issue
 
-		for _, issue := range cache.Issues {
-			if _, isClosed := closed[issue.Status.ID]; !isClosed {
-				issues = append(issues, issue)
+		if alfred.FuzzyMatches("watching:", parts[0]) {
+			watching := isWatching(issue)
+			item := alfred.Item{
+				Title: "Watching",
+				Arg: &alfred.ItemArg{
+					Keyword: issuesKeyword,
+					Mode:    alfred.ModeDo,
+					Data: stringifyIssueCfg(issueCfg{
+						ToWatch: &watchIssueMessage{
+							ID:    issue.ID,
+							Watch: !watching,
+						},
+					}),
+				},
+			}
+			if watching {
+				item.Subtitle = "Press Enter to stop watching this issue"
+			} else {
+				item.Subtitle = "Press Enter to start watching this issue"
+			}
+			item.AddCheckBox(watching)
+			items = append(items, item)
+		}
+
+		if alfred.FuzzyMatches("relations:", parts[0]) {
+			for _, relation := range issue.Relations {
+				label, otherID := describeRelation(issue.ID, relation)
+				item := alfred.Item{
+					Title: fmt.Sprintf("%s #%d", label, otherID),
+					Arg: &alfred.ItemArg{
+						Keyword: issuesKeyword,
+						Data:    stringifyIssueCfg(issueCfg{IssueID: &otherID}),
+					},
+				}
+
+				if other, ok := findIssue(otherID); ok {
+					item.Title += ": " + other.Subject
+					item.Subtitle = fmt.Sprintf("%s [%s]", other.Status.Name, other.Project.Name)
+				}
+
+				item.AddMod(alfred.ModCmd, alfred.ItemMod{
+					Subtitle: "Remove this relation",
+					Arg: &alfred.ItemArg{
+						Keyword: issuesKeyword,
+						Mode:    alfred.ModeDo,
+						Data: stringifyIssueCfg(issueCfg{
+							ToUnrelate: &relateIssueMessage{
+								ID:       issue.ID,
+								Relation: relation,
+							},
+						}),
+					},
+				})
+
+				items = append(items, item)
+			}
+		}
+
+		if alfred.FuzzyMatches("relate:", parts[0]) {
+			if parts[0] == "Relate:" && len(parts) == 2 {
+				rel := alfred.CleanSplitN(parts[1], " ", 2)
+				for _, relType := range relationTypes {
+					if !alfred.FuzzyMatches(relType, rel[0]) {
+						continue
+					}
+
+					label := relationLabels[relType][0]
+					if len(rel) == 2 {
+						if otherID, err := strconv.Atoi(strings.TrimPrefix(rel[1], "#")); err == nil {
+							items = append(items, alfred.Item{
+								Title:    fmt.Sprintf("%s #%d", label, otherID),
+								Subtitle: fmt.Sprintf("Relate issue %d to issue %d", issue.ID, otherID),
+								Arg: &alfred.ItemArg{
+									Keyword: issuesKeyword,
+									Mode:    alfred.ModeDo,
+									Data: stringifyIssueCfg(issueCfg{
+										ToRelate: &relateIssueMessage{
+											ID: issue.ID,
+											Relation: Relation{
+												IssueID:      issue.ID,
+												IssueToID:    otherID,
+												RelationType: relType,
+											},
+										},
+									}),
+								},
+							})
+						}
+					} else {
+						items = append(items, alfred.Item{
+							Title:        label + "...",
+							Subtitle:     "Type the number of the other issue",
+							Autocomplete: "Relate: " + relType + " ",
+						})
+					}
+				}
+			} else {
+				items = append(items, alfred.Item{
+					Title:        "Relate: add a relation",
+					Subtitle:     "relates, blocks, precedes, duplicates or copied_to",
+					Autocomplete: "Relate: ",
+				})
+			}
+		}
+
+		if parts[0] != "Attach:" && alfred.FuzzyMatches("attachments:", parts[0]) {
+			for i := range issue.Attachments {
+				attachment := issue.Attachments[i]
+				subTitle := fmt.Sprintf("%s, added by %s", toHumanFileSize(attachment.Filesize), attachment.Author.Name)
+				if created, err := time.Parse(time.RFC3339, attachment.CreatedOn); err == nil {
+					subTitle += " " + toHumanDateString(created.Local())
+				}
+
+				item := alfred.Item{
+					Title:    "Attachment: " + attachment.Filename,
+					Subtitle: subTitle,
+					Arg: &alfred.ItemArg{
+						Keyword: issuesKeyword,
+						Mode:    alfred.ModeDo,
+						Data:    stringifyIssueCfg(issueCfg{ToDownload: &attachment}),
+					},
+				}
+
+				item.AddMod(alfred.ModCmd, alfred.ItemMod{
+					Subtitle: "Open the attachment on Redmine...",
+					Arg: &alfred.ItemArg{
+						Keyword: issuesKeyword,
+						Mode:    alfred.ModeDo,
+						Data:    stringifyIssueCfg(issueCfg{ToOpen: getAttachmentURL(attachment)}),
+					},
+				})
+
+				items = append(items, item)
 			}
 		}
 
-		items = append(items, createIssueItems(arg, pid, issues)...)
+		if alfred.FuzzyMatches("attach:", parts[0]) {
+			if parts[0] == "Attach:" && len(parts) == 2 {
+				file := expandPath(parts[1])
+				items = append(items, alfred.Item{
+					Title:    "Attach " + filepath.Base(file),
+					Subtitle: file,
+					Arg: &alfred.ItemArg{
+						Keyword: issuesKeyword,
+						Mode:    alfred.ModeDo,
+						Data: stringifyIssueCfg(issueCfg{
+							ToAttach: &attachFileMessage{
+								ID:   issue.ID,
+								File: file,
+							},
+						}),
+					},
+				})
+			} else {
+				items = append(items, alfred.Item{
+					Title:        "Attach: a file",
+					Subtitle:     "Type or paste the path of a file to upload",
+					Autocomplete: "Attach: ",
+				})
+			}
+		}
+	} else {
+		if pid == -1 && config.MergeProfiles {
+			items = append(items, createMergedIssueItems(arg)...)
+		} else {
+			items = append(items, createIssueItems(arg, pid, getOpenIssues())...)
+		}
+
+		// the closed issues being watched aren't cached, so the cleanup is
+		// only offered when asked for
+		if pid == -1 && arg != "" {
+			title := "Unwatch closed issues"
+			if alfred.FuzzyMatches(title, arg) {
+				items = append(items, alfred.Item{
+					Title:    title,
+					Subtitle: "Stop watching all your closed issues",
+					Arg: &alfred.ItemArg{
+						Keyword: issuesKeyword,
+						Mode:    alfred.ModeDo,
+						Data:    stringifyIssueCfg(issueCfg{ToUnwatchClosed: true}),
+					},
+				})
+			}
+		}
 
 		if arg == "" {
 			if pid == -1 {
@@ -117,7 +397,7 @@ func (c IssuesCommand) Items(arg, data string) (items []alfred.Item, err error)
 					Arg: &alfred.ItemArg{
 						Keyword: issuesKeyword,
 						Mode:    alfred.ModeDo,
-						Data:    alfred.Stringify(&issueCfg{ToOpen: getMyIssuesURL()}),
+						Data:    stringifyIssueCfg(issueCfg{ToOpen: getMyIssuesURL()}),
 					},
 				}
 				items = alfred.InsertItem(items, item, 0)
@@ -126,7 +406,7 @@ func (c IssuesCommand) Items(arg, data string) (items []alfred.Item, err error)
 				pi := indexOfByID(projectList(cache.Projects), pid)
 				project := cache.Projects[pi]
 				item := alfred.Item{
-					Title:    project.Name,
+					Title:    getProjectPath(project),
 					Subtitle: alfred.Line,
 					Arg:      &alfred.ItemArg{Keyword: projectsKeyword},
 				}
@@ -140,6 +420,8 @@ func (c IssuesCommand) Items(arg, data string) (items []alfred.Item, err error)
 
 // Do runs the command
 func (c IssuesCommand) Do(data string) (out string, err error) {
+	defer startAction()()
+
 	var cfg issueCfg
 	if data != "" {
 		if err := json.Unmarshal([]byte(data), &cfg); err != nil {
@@ -147,34 +429,163 @@ func (c IssuesCommand) Do(data string) (out string, err error) {
 		}
 	}
 
+	if cfg.Profile != "" && cfg.Profile != config.Profile {
+		err = withProfile(cfg.Profile, func() (err error) {
+			out, err = c.Do(data)
+			return
+		})
+		return
+	}
+
 	if cfg.ToOpen != "" {
 		err = exec.Command("open", cfg.ToOpen).Run()
 	}
 
 	if cfg.ToUpdate != nil {
 		toUpdate := *cfg.ToUpdate
-		session := OpenSession(config.RedmineURL, config.APIKey)
+		session := openSession()
 
-		if err = session.UpdateIssue(toUpdate.ID, toUpdate.Issue); err != nil {
+		if err = session.UpdateIssueContext(commandCtx, toUpdate.ID, toUpdate.Issue); err != nil {
 			return
 		}
 
-		var issue Issue
-		if issue, err = session.GetIssue(toUpdate.ID); err != nil {
+		if err = refreshCachedIssue(&session, toUpdate.ID); err != nil {
 			return
 		}
 
-		for i := range cache.Issues {
-			if cache.Issues[i].ID == issue.ID {
-				cache.Issues[i] = issue
-				if err := alfred.SaveJSON(cacheFile, &cache); err != nil {
-					log.Printf("Error saving cache: %v\n", err)
-				}
-				break
+		out = fmt.Sprintf("Updated issue %d", toUpdate.ID)
+	}
+
+	if cfg.ToCreate != nil {
+		session := openSession()
+
+		var created Issue
+		if created, err = createIssue(&session, *cfg.ToCreate); err != nil {
+			return
+		}
+
+		out = fmt.Sprintf("Created issue %d", created.ID)
+	}
+
+	if cfg.ToWatch != nil {
+		toWatch := *cfg.ToWatch
+		session := openSession()
+
+		if toWatch.Watch {
+			err = session.AddWatcherContext(commandCtx, toWatch.ID, cache.User.ID)
+			out = fmt.Sprintf("Watching issue %d", toWatch.ID)
+		} else {
+			err = session.RemoveWatcherContext(commandCtx, toWatch.ID, cache.User.ID)
+			out = fmt.Sprintf("Stopped watching issue %d", toWatch.ID)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		// watching doesn't change an issue's update time, so an incremental
+		// refresh wouldn't notice
+		if err = updateWatchedIssue(&session, toWatch.ID, toWatch.Watch); err != nil {
+			return
+		}
+	}
+
+	if cfg.ToRelate != nil || cfg.ToUnrelate != nil {
+		session := openSession()
+
+		var msg relateIssueMessage
+		if cfg.ToRelate != nil {
+			msg = *cfg.ToRelate
+			var created Relation
+			if created, err = session.CreateRelationContext(commandCtx, msg.ID, msg.Relation); err != nil {
+				return
+			}
+			if created.IssueID != 0 {
+				msg.Relation = created
+			}
+			out = fmt.Sprintf("Related issue %d to issue %d", msg.ID, msg.Relation.IssueToID)
+		} else {
+			msg = *cfg.ToUnrelate
+			if err = session.DeleteRelationContext(commandCtx, msg.Relation.ID); err != nil {
+				return
 			}
+			out = fmt.Sprintf("Removed relation from issue %d", msg.ID)
 		}
 
-		out = fmt.Sprintf("Updated issue %d", toUpdate.ID)
+		// both sides of the relation have changed
+		_, otherID := describeRelation(msg.ID, msg.Relation)
+		for _, id := range []int{msg.ID, otherID} {
+			if _, ok := findIssue(id); !ok {
+				continue
+			}
+			if err = refreshCachedIssue(&session, id); err != nil {
+				return
+			}
+		}
+
+		if err = getRelatedIssues(&session); err != nil {
+			return
+		}
+		if err := saveCache(); err != nil {
+			log.Printf("Error saving cache: %v\n", err)
+		}
+	}
+
+	if cfg.ToUnwatchClosed {
+		var count int
+		if count, err = unwatchClosedIssues(); err != nil {
+			return
+		}
+		out = fmt.Sprintf("Stopped watching %d closed issues", count)
+	}
+
+	if cfg.ToDownload != nil {
+		attachment := *cfg.ToDownload
+		session := openSession()
+
+		var content []byte
+		if content, err = session.GetAttachmentContext(commandCtx, attachment); err != nil {
+			return
+		}
+
+		dir := getDownloadDir()
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return
+		}
+
+		var f *os.File
+		if f, err = createDownloadFile(dir, attachment.Filename); err != nil {
+			return
+		}
+		_, err = f.Write(content)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return
+		}
+
+		out = fmt.Sprintf("Downloaded %s to %s", filepath.Base(f.Name()), dir)
+	}
+
+	if cfg.ToAttach != nil {
+		toAttach := *cfg.ToAttach
+		session := openSession()
+
+		var upload Upload
+		if upload, err = session.UploadFileContext(commandCtx, toAttach.File); err != nil {
+			return
+		}
+
+		if err = session.UpdateIssueContext(commandCtx, toAttach.ID, UpdateIssue{Uploads: []Upload{upload}}); err != nil {
+			return
+		}
+
+		if err = refreshCachedIssue(&session, toAttach.ID); err != nil {
+			return
+		}
+
+		out = fmt.Sprintf("Attached %s to issue %d", upload.Filename, toAttach.ID)
 	}
 
 	return
@@ -185,10 +596,18 @@ func (c IssuesCommand) Do(data string) (out string, err error) {
 const issuesKeyword = "issues"
 
 type issueCfg struct {
-	IssueID   *int
-	ProjectID *int
-	ToUpdate  *updateIssueMessage
-	ToOpen    string
+	Profile         string
+	IssueID         *int
+	ProjectID       *int
+	ToUpdate        *updateIssueMessage
+	ToOpen          string
+	ToDownload      *Attachment
+	ToAttach        *attachFileMessage
+	ToWatch         *watchIssueMessage
+	ToCreate        *UpdateIssue
+	ToRelate        *relateIssueMessage
+	ToUnrelate      *relateIssueMessage
+	ToUnwatchClosed bool
 }
 
 type updateIssueMessage struct {
@@ -196,9 +615,203 @@ type updateIssueMessage struct {
 	Issue UpdateIssue
 }
 
-func createIssueItems(arg string, pid int, issues []Issue) (items []alfred.Item) {
-	var filtered []Issue
+type attachFileMessage struct {
+	ID   int
+	File string
+}
+
+type relateIssueMessage struct {
+	ID       int
+	Relation Relation
+}
+
+type watchIssueMessage struct {
+	ID    int
+	Watch bool
+}
+
+func getOpenIssues() (issues []Issue) {
+	closed := getClosedStatusIDs()
+	for _, issue := range cache.Issues {
+		if _, isClosed := closed[issue.Status.ID]; !isClosed {
+			issues = append(issues, issue)
+		}
+	}
+	return
+}
+
+// unwatchClosedIssues stops watching every closed issue the user is watching
+// and removes those issues from the cache. It returns the number of issues
+// that were unwatched; if some couldn't be, an error is returned as well.
+func unwatchClosedIssues() (count int, err error) {
+	session := openSession()
+
+	// long-closed issues aren't cached, so the server is asked for them
+	var closed []Issue
+	if closed, err = session.GetWatchedClosedIssuesContext(commandCtx); err != nil {
+		return
+	}
+
+	unwatched := map[int]bool{}
+	failed := 0
+
+	for _, issue := range closed {
+		if err := session.RemoveWatcherContext(commandCtx, issue.ID, cache.User.ID); err != nil {
+			log.Printf("Error unwatching issue %d: %v", issue.ID, err)
+			failed++
+			continue
+		}
+		unwatched[issue.ID] = true
+	}
+
+	var issues []Issue
+	for _, issue := range cache.Issues {
+		if !unwatched[issue.ID] {
+			issues = append(issues, issue)
+		}
+	}
+	cache.Issues = issues
+
+	if err := saveCache(); err != nil {
+		log.Printf("Error saving cache: %v\n", err)
+	}
+
+	count = len(unwatched)
+	if failed > 0 {
+		err = fmt.Errorf("Stopped watching %d closed issues, but %d could not be unwatched", count, failed)
+	}
+	return
+}
+
+// updateWatchedIssue reloads an issue that has just been watched or unwatched,
+// and adds it to or removes it from the watched issues. An unwatched issue is
+// kept with the related issues so that it can still be shown.
+func updateWatchedIssue(session *Session, id int, watched bool) (err error) {
+	var issue Issue
+	if issue, err = session.GetIssueContext(commandCtx, id); err != nil {
+		return
+	}
+
+	var issues []Issue
+	for _, i := range cache.Issues {
+		if i.ID != id {
+			issues = append(issues, i)
+		}
+	}
+	var related []Issue
+	for _, i := range cache.RelatedIssues {
+		if i.ID != id {
+			related = append(related, i)
+		}
+	}
+
+	if watched {
+		issues = append(issues, issue)
+	} else {
+		related = append(related, issue)
+	}
+	cache.Issues = issues
+	cache.RelatedIssues = related
+
+	if err := saveCache(); err != nil {
+		log.Printf("Error saving cache: %v\n", err)
+	}
+	return
+}
+
+// stringifyIssueCfg serializes an issue config, tagging it with the active
+// profile so that items from merged issue lists act on the right server
+func stringifyIssueCfg(cfg issueCfg) string {
+	cfg.Profile = config.Profile
+	return alfred.Stringify(&cfg)
+}
+
+// createIssue creates an issue and adds it to the cache
+func createIssue(session *Session, newIssue UpdateIssue) (issue Issue, err error) {
+	var created Issue
+	if created, err = session.CreateIssueContext(commandCtx, newIssue); err != nil {
+		return
+	}
+
+	if issue, err = session.GetIssueContext(commandCtx, created.ID); err != nil {
+		return
+	}
+	cache.Issues = append(cache.Issues, issue)
+
+	if parentID := newIssue.ParentIssue; parentID != 0 {
+		if _, ok := findIssue(parentID); ok {
+			if err = refreshCachedIssue(session, parentID); err != nil {
+				return
+			}
+		}
+	}
+
+	if err := saveCache(); err != nil {
+		log.Printf("Error saving cache: %v\n", err)
+	}
+
+	return
+}
+
+// refreshCachedIssue reloads an issue from Redmine and replaces the cached copy
+func refreshCachedIssue(session *Session, id int) (err error) {
+	var issue Issue
+	if issue, err = session.GetIssueContext(commandCtx, id); err != nil {
+		return
+	}
+
+	for _, list := range [][]Issue{cache.Issues, cache.RelatedIssues} {
+		for i := range list {
+			if list[i].ID == issue.ID {
+				list[i] = issue
+				if err := saveCache(); err != nil {
+					log.Printf("Error saving cache: %v\n", err)
+				}
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func getAttachmentURL(attachment Attachment) string {
+	return fmt.Sprintf("%s/attachments/%d", config.RedmineURL, attachment.ID)
+}
+
+func getDownloadDir() string {
+	if config.DownloadDir != "" {
+		return expandPath(config.DownloadDir)
+	}
+	return filepath.Join(os.Getenv("HOME"), "Downloads")
+}
+
+// createDownloadFile creates a new file in dir for a download. The server's
+// name for the file is stripped of any directories, and a number is added to
+// it rather than replacing a file that already exists, like "name (1).ext".
+func createDownloadFile(dir, name string) (*os.File, error) {
+	name = filepath.Base(filepath.FromSlash(strings.Replace(name, `\`, "/", -1)))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		name = "attachment"
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		file := filepath.Join(dir, name)
+		if i > 0 {
+			file = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
 
+// filterIssues returns the issues in a project that match arg. A pid of -1
+// matches issues in any project.
+func filterIssues(arg string, pid int, issues []Issue) (filtered []Issue) {
 	for i := range issues {
 		if pid != -1 && pid != issues[i].Project.ID {
 			// If a project ID was given, only use issues for that project
@@ -209,10 +822,24 @@ func createIssueItems(arg string, pid int, issues []Issue) (items []alfred.Item)
 			filtered = append(filtered, issues[i])
 		}
 	}
+	return
+}
+
+func createIssueItems(arg string, pid int, issues []Issue) (items []alfred.Item) {
+	filtered := filterIssues(arg, pid, issues)
 
 	sort.Sort(byDueDate(filtered))
 	sort.Stable(sort.Reverse(byPriority(filtered)))
 	sort.Stable(byAssignment(filtered))
+	sort.Stable(byBlocked(filtered))
+
+	if pid != -1 && config.NestSubtasks {
+		nested, depths := nestSubtasks(filtered)
+		for i := range nested {
+			items = append(items, indentSubtask(nested[i].toItem(), depths[i]))
+		}
+		return
+	}
 
 	for i := range filtered {
 		items = append(items, filtered[i].toItem())
@@ -221,6 +848,68 @@ func createIssueItems(arg string, pid int, issues []Issue) (items []alfred.Item)
 	return
 }
 
+// mergedIssue is an issue from one of the profiles in a merged list, along
+// with what's needed to sort it after its profile is no longer active.
+type mergedIssue struct {
+	issue   Issue
+	item    alfred.Item
+	mine    bool
+	blocked bool
+}
+
+// createMergedIssueItems lists the matching open issues of every profile,
+// sorted together the way createIssueItems sorts a single profile's issues.
+func createMergedIssueItems(arg string) (items []alfred.Item) {
+	var merged []mergedIssue
+	add := func() {
+		for _, issue := range filterIssues(arg, -1, getOpenIssues()) {
+			merged = append(merged, mergedIssue{
+				issue:   issue,
+				item:    issue.toItem(),
+				mine:    issue.AssignedTo.ID == cache.User.ID,
+				blocked: len(getBlockers(issue)) > 0,
+			})
+		}
+	}
+
+	add()
+	for _, p := range config.Profiles {
+		if p.Name == config.Profile {
+			continue
+		}
+
+		err := withProfile(p.Name, func() error {
+			if err := checkRefresh(resUser, resStatuses, resProjects, resIssues); err != nil {
+				return err
+			}
+			add()
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error listing issues for profile %s: %v", p.Name, err)
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		a, b := merged[i], merged[j]
+		if a.blocked != b.blocked {
+			return !a.blocked
+		}
+		if a.mine != b.mine {
+			return a.mine
+		}
+		if a.issue.Priority.ID != b.issue.Priority.ID {
+			return a.issue.Priority.ID > b.issue.Priority.ID
+		}
+		return dueDateIsBefore(a.issue.DueDate, b.issue.DueDate)
+	})
+
+	for i := range merged {
+		items = append(items, merged[i].item)
+	}
+	return
+}
+
 func getMyIssuesURL() string {
 	return config.RedmineURL + "/issues?utf8=✓&set_filter=1&" +
 		"f[]=assigned_to_id&op[assigned_to_id]==&v[assigned_to_id][]=me&" +
@@ -230,12 +919,27 @@ func getMyIssuesURL() string {
 
 func (i *Issue) toItem() (item alfred.Item) {
 	subTitle := fmt.Sprintf("%d [%s]", i.ID, i.Project.Name)
+	if config.MergeProfiles && len(config.Profiles) > 1 {
+		subTitle = config.Profile + " · " + subTitle
+	}
 	if i.DueDate != "" {
 		dueDate, _ := time.Parse("2006-01-02", i.DueDate)
 		subTitle += " Due " + toHumanDateString(dueDate) + ","
 	}
 	subTitle += " " + i.Priority.Name
 
+	if blockers := getBlockers(*i); len(blockers) > 0 {
+		var ids []string
+		for _, id := range blockers {
+			ids = append(ids, "#"+strconv.Itoa(id))
+		}
+		subTitle += ", blocked by " + strings.Join(ids, ", ")
+	}
+
+	if chain := getParentChain(*i); len(chain) > 0 {
+		subTitle += ", in " + strings.Join(chain, " › ")
+	}
+
 	item.Title = i.Subject
 	item.Subtitle = subTitle
 	item.Autocomplete = strconv.Itoa(i.ID)
@@ -243,7 +947,7 @@ func (i *Issue) toItem() (item alfred.Item) {
 	url := fmt.Sprintf("%s/issues/%v", config.RedmineURL, i.ID)
 	item.Arg = &alfred.ItemArg{
 		Keyword: issuesKeyword,
-		Data:    alfred.Stringify(&issueCfg{IssueID: &i.ID}),
+		Data:    stringifyIssueCfg(issueCfg{IssueID: &i.ID}),
 	}
 
 	item.AddMod(alfred.ModCmd, alfred.ItemMod{
@@ -251,7 +955,7 @@ func (i *Issue) toItem() (item alfred.Item) {
 		Arg: &alfred.ItemArg{
 			Keyword: issuesKeyword,
 			Mode:    alfred.ModeDo,
-			Data:    alfred.Stringify(&issueCfg{ToOpen: url}),
+			Data:    stringifyIssueCfg(issueCfg{ToOpen: url}),
 		},
 	})
 
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateDownloadFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.pdf"), []byte("mine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct{ name, want string }{
+		{"report.pdf", "report (1).pdf"},
+		{"report.pdf", "report (2).pdf"},
+		{"../../.ssh/authorized_keys", "authorized_keys"},
+		{`..\evil.txt`, "evil.txt"},
+		{"..", "attachment"},
+	} {
+		f, err := createDownloadFile(dir, test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if f.Name() != filepath.Join(dir, test.want) {
+			t.Errorf("saved %q as %s, want %s", test.name, f.Name(), test.want)
+		}
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(dir, "report.pdf")); string(data) != "mine" {
+		t.Error("existing file was overwritten")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Log levels, from least to most verbose. Messages from the standard logger
+// are logged at info, dlog messages at debug, and tlog messages (request and
+// response bodies) at trace.
+const (
+	logOff = iota
+	logInfo
+	logDebug
+	logTrace
+)
+
+var logLevelNames = []string{"off", "info", "debug", "trace"}
+
+// the log file is rotated when it grows beyond this size
+const maxLogSize = 512 * 1024
+
+var dlog = log.New(levelWriter{logDebug}, "[redmine] ", log.LstdFlags)
+var tlog = log.New(levelWriter{logTrace}, "[redmine] ", log.LstdFlags)
+
+// logFile is set once the workflow's cache directory is known
+var logFile string
+
+var secrets struct {
+	sync.Mutex
+	values []string
+}
+
+var redactions = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// "api_key": "...", password=..., X-Redmine-API-Key: ..., etc.
+	{
+		regexp.MustCompile(`(?i)("?(?:api_?key|x-redmine-api-key|password|passwd|token|secret)"?\s*[:=]\s*"?)[^"\s,&}]+`),
+		"${1}[REDACTED]",
+	},
+	// Redmine API keys are 40 hex digits
+	{regexp.MustCompile(`\b[0-9a-fA-F]{40}\b`), "[REDACTED]"},
+}
+
+// addSecret registers a value that must never be written to the log.
+func addSecret(value string) {
+	if value == "" {
+		return
+	}
+
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, s := range secrets.values {
+		if s == value {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, value)
+}
+
+// redact removes credentials and tokens from a log line.
+func redact(line string) string {
+	secrets.Lock()
+	for _, s := range secrets.values {
+		line = strings.Replace(line, s, "[REDACTED]", -1)
+	}
+	secrets.Unlock()
+
+	for _, r := range redactions {
+		line = r.pattern.ReplaceAllString(line, r.replacement)
+	}
+	return line
+}
+
+func getLogLevel() int {
+	level := strings.ToLower(strings.TrimSpace(config.LogLevel))
+	for i, name := range logLevelNames {
+		if level == name {
+			return i
+		}
+	}
+	return logInfo
+}
+
+// A levelWriter writes redacted log lines to stderr and the log file if its
+// level is enabled.
+type levelWriter struct {
+	level int
+}
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	if getLogLevel() < w.level {
+		return len(p), nil
+	}
+
+	line := redact(string(p))
+	os.Stderr.WriteString(line)
+
+	if logFile != "" {
+		if err := appendLog(line); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing log file: %v\n", err)
+		}
+	}
+
+	return len(p), nil
+}
+
+var logFileLock sync.Mutex
+
+func appendLog(line string) error {
+	logFileLock.Lock()
+	defer logFileLock.Unlock()
+
+	if info, err := os.Stat(logFile); err == nil && info.Size() > maxLogSize {
+		if err := os.Rename(logFile, logFile+".1"); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(line)
+	return err
+}
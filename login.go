@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/jason0x43/go-alfred"
 )
@@ -12,10 +16,15 @@ type LoginCommand struct{}
 
 // About returns information about a command
 func (c LoginCommand) About() alfred.CommandDef {
+	description := "Login to a Redmine server"
+	if isExpired() {
+		description = errSessionExpired.Error()
+	}
+
 	return alfred.CommandDef{
 		Keyword:     "login",
-		Description: "Login to your Redmine server",
-		IsEnabled:   config.APIKey == "",
+		Description: description,
+		IsEnabled:   true,
 		Arg: &alfred.ItemArg{
 			Keyword: "login",
 			Mode:    alfred.ModeDo,
@@ -28,7 +37,17 @@ func (c LoginCommand) Do(data string) (out string, err error) {
 	var btn string
 	var urlStr string
 
-	if btn, urlStr, err = workflow.GetInput("Redmine server URL", "", false); err != nil {
+	// when renewing an expired login, default to the same server and profile;
+	// when logged out, to the server set in the options
+	var defaultURL, defaultName string
+	if isExpired() {
+		defaultURL = config.RedmineURL
+		defaultName = config.Profile
+	} else if config.APIKey == "" {
+		defaultURL = config.RedmineURL
+	}
+
+	if btn, urlStr, err = workflow.GetInput("Redmine server URL", defaultURL, false); err != nil {
 		return
 	}
 	if btn != "Ok" {
@@ -37,9 +56,186 @@ func (c LoginCommand) Do(data string) (out string, err error) {
 	}
 	dlog.Printf("URL: %s", urlStr)
 
+	// a new server starts without any connection settings, so that another
+	// server's certificates, pinned keys, gateway password and headers are
+	// never used with it. Renewing a login keeps the profile's own settings,
+	// and settings made in the options while logged out are used for the
+	// server being added.
+	var server profile
+	if (isExpired() && urlStr == defaultURL) || config.APIKey == "" {
+		server = activeProfile()
+	}
+	server.Name = ""
+	server.RedmineURL = urlStr
+	server.APIKey = ""
+
+	var ok bool
+	if ok, err = connect(&server); !ok || err != nil {
+		return
+	}
+
+	// an API key works with accounts using two-factor authentication or
+	// single sign-on, where a password login isn't possible
+	var apiKey string
+	if btn, apiKey, err = workflow.GetInput("API key (from My account; leave empty to use a password)", "", true); err != nil {
+		return
+	}
+	if btn != "Ok" {
+		dlog.Println("User didn't click OK")
+		return
+	}
+
+	server.APIKey = apiKey
+
+	var session Session
+	if apiKey != "" {
+		dlog.Printf("api key: *****")
+
+		// the command's deadline may have passed while the user was typing
+		ctx, cancel := context.WithTimeout(context.Background(), getTimeout())
+		defer cancel()
+
+		session = newSession(server)
+		if _, err = session.GetUserContext(ctx); err != nil {
+			workflow.ShowMessage("Login failed: " + describeLoginError(err, true))
+			return "", nil
+		}
+	} else if session, err = passwordLogin(server); err != nil || session.APIKey() == "" {
+		return
+	}
+
+	if defaultName == "" || urlStr != defaultURL {
+		defaultName = getDefaultProfileName(urlStr)
+	}
+
+	var name string
+	if btn, name, err = workflow.GetInput("Profile name", defaultName, false); err != nil {
+		return
+	}
+	if btn != "Ok" || name == "" {
+		name = defaultName
+	}
+	dlog.Printf("profile: %s", name)
+
+	p := server
+	p.Name = name
+	p.APIKey = session.APIKey()
+	addProfile(p)
+	useProfile(p)
+	if err = saveConfig(); err != nil {
+		workflow.ShowMessage(fmt.Sprintf("Unable to save API key: %s", err))
+		return
+	}
+
+	workflow.ShowMessage("Login successful!")
+	return
+}
+
+// support -------------------------------------------------------------------
+
+// connect makes sure a server can be reached with its connection settings,
+// and sets up connections for it. If it can't be, the user is asked for
+// different settings until it can, or until they give up, in which case ok is
+// false.
+func connect(server *profile) (ok bool, err error) {
+	for {
+		var connErr error
+		if connErr = configureClientFor(*server); connErr == nil {
+			// the server is reachable if it answers at all, even if only to
+			// say that no one is logged in
+			ctx, cancel := context.WithTimeout(context.Background(), getTimeout())
+			session := OpenSession(server.RedmineURL, "")
+			_, connErr = session.GetUserContext(ctx)
+			cancel()
+			if _, isHTTP := connErr.(HTTPError); isHTTP {
+				connErr = nil
+			}
+		}
+		if connErr == nil {
+			return true, nil
+		}
+		log.Println("Error connecting to server:", connErr)
+
+		var btn, settings string
+		prompt := fmt.Sprintf("Unable to connect (%s). Connection settings for this server, like CAFile=~/ca.pem; Proxy=http://proxy:3128", connErr)
+		if btn, settings, err = workflow.GetInput(prompt, formatConnectionSettings(*server), false); err != nil {
+			return
+		}
+		if btn != "Ok" {
+			dlog.Println("User didn't click OK")
+			return
+		}
+		if err = parseConnectionSettings(settings, server); err != nil {
+			workflow.ShowMessage(err.Error())
+			return false, nil
+		}
+	}
+}
+
+// connectionSettingNames are the settings that can be given for a server that
+// can't be connected to.
+var connectionSettingNames = []string{"AllowSelfSigned", "CAFile", "PinnedKeys", "ClientCert", "ClientKey", "Proxy"}
+
+// formatConnectionSettings lists a profile's connection settings like
+// "CAFile=~/ca.pem; Proxy=none".
+func formatConnectionSettings(p profile) string {
+	v := reflect.ValueOf(p)
+	var settings []string
+	for _, name := range connectionSettingNames {
+		if f := v.FieldByName(name); !f.IsZero() {
+			settings = append(settings, fmt.Sprintf("%s=%v", name, f.Interface()))
+		}
+	}
+	return strings.Join(settings, "; ")
+}
+
+// parseConnectionSettings reads a list of connection settings written by
+// formatConnectionSettings into a profile, replacing its existing ones.
+func parseConnectionSettings(settings string, p *profile) error {
+	v := reflect.ValueOf(p).Elem()
+	for _, name := range connectionSettingNames {
+		v.FieldByName(name).Set(reflect.Zero(v.FieldByName(name).Type()))
+	}
+
+	for _, setting := range strings.Split(settings, ";") {
+		if strings.TrimSpace(setting) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(setting, "=", 2)
+		var f reflect.Value
+		for _, name := range connectionSettingNames {
+			if strings.EqualFold(name, strings.TrimSpace(parts[0])) {
+				f = v.FieldByName(name)
+			}
+		}
+		if len(parts) != 2 || !f.IsValid() {
+			return fmt.Errorf("Unknown connection setting: %s", strings.TrimSpace(setting))
+		}
+
+		value := strings.TrimSpace(parts[1])
+		if f.Kind() == reflect.Bool {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s: %s", strings.TrimSpace(parts[0]), value)
+			}
+			f.SetBool(b)
+		} else {
+			f.SetString(value)
+		}
+	}
+
+	return nil
+}
+
+// passwordLogin asks for a username and password and uses them to get the
+// user's API key from a server. The returned session has no API key if the
+// user cancelled or the login failed.
+func passwordLogin(server profile) (session Session, err error) {
+	var btn string
 	var username string
 	if btn, username, err = workflow.GetInput("Username", "", false); err != nil {
-		return "", err
+		return
 	}
 	if btn != "Ok" {
 		dlog.Println("User didn't click OK")
@@ -51,22 +247,37 @@ func (c LoginCommand) Do(data string) (out string, err error) {
 	btn, password, err = workflow.GetInput("Password", "", true)
 	if btn != "Ok" {
 		log.Println("User didn't click OK")
-		return "", nil
+		return session, nil
 	}
 	dlog.Printf("password: *****")
 
-	var session Session
-	if session, err = NewSession(urlStr, username, password); err != nil {
-		workflow.ShowMessage(fmt.Sprintf("Login failed: %s", err))
-		return
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), getTimeout())
+	defer cancel()
 
-	config.RedmineURL = urlStr
-	config.APIKey = session.APIKey()
-	if err = alfred.SaveJSON(configFile, &config); err != nil {
-		return
+	session = newSession(server)
+	if err = session.LogInContext(ctx, username, password); err != nil {
+		workflow.ShowMessage("Login failed: " + describeLoginError(err, false))
+		return Session{}, nil
 	}
 
-	workflow.ShowMessage("Login successful!")
 	return
 }
+
+// describeLoginError explains why the server rejected a login.
+func describeLoginError(err error, withKey bool) string {
+	if isTimeout(err) {
+		return "the server didn't respond in time"
+	}
+	if e, ok := err.(HTTPError); ok {
+		switch e.StatusCode {
+		case 401:
+			if withKey {
+				return "the API key is wrong or has been revoked"
+			}
+			return "the username or password is wrong"
+		case 403, 404:
+			return "the REST API isn't enabled on this server (or the URL is wrong)"
+		}
+	}
+	return err.Error()
+}
@@ -20,8 +20,27 @@ func (c LogoutCommand) About() alfred.CommandDef {
 
 // Do runs the command
 func (c LogoutCommand) Do(data string) (out string, err error) {
+	// logging out removes the active profile and its API key; switch to
+	// another profile if there is one
+	if err = getCredentialStore().Delete(config.Profile); err != nil {
+		return
+	}
+	if err = getCredentialStore().Delete(gatewayCredential(config.Profile)); err != nil {
+		return
+	}
+	removeProfile(config.Profile)
+	config.Profile = ""
 	config.APIKey = ""
-	if err = alfred.SaveJSON(configFile, &config); err != nil {
+	config.GatewayPassword = ""
+	if len(config.Profiles) > 0 {
+		useProfile(config.Profiles[0])
+	} else {
+		// the next server logged in to starts without any connection
+		// settings
+		setActiveProfile(profile{})
+	}
+
+	if err = saveConfig(); err != nil {
 		return
 	}
 
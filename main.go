@@ -1,63 +1,130 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/jason0x43/go-alfred"
 )
 
-var cacheFile string
+var localStore *cacheStore
 var configFile string
 var workflow alfred.Workflow
-var config struct {
-	APIKey          string `desc:"Server API key"`
-	RedmineURL      string `desc:"Server URL"`
-	AllowSelfSigned bool   `desc:"If true, accept self-signed SSL certificates"`
+var config configData
+var cache cacheData
+
+type configData struct {
+	APIKey            string
+	RedmineURL        string `desc:"Server URL"`
+	AllowSelfSigned   bool   `desc:"If true, accept self-signed SSL certificates"`
+	CAFile            string `desc:"PEM file of extra CA certificates to trust for the server"`
+	PinnedKeys        string `desc:"Comma-separated base64 SHA-256 hashes of the server's public keys (SPKI); one must match"`
+	ClientCert        string `desc:"PEM client certificate file, for servers that require one"`
+	ClientKey         string `desc:"PEM private key file for ClientCert"`
+	Proxy             string `desc:"Proxy URL, none to connect directly, or empty to use the HTTPS_PROXY environment variable"`
+	Headers           string `desc:"Extra headers sent with every request, e.g. X-Team: infra; X-Env: prod"`
+	GatewayUser       string `desc:"Username for a gateway's basic auth, if Redmine is behind one (requires an API key login)"`
+	GatewayPassword   string `desc:"Password for the gateway's basic auth; kept in the credential store" secret:"true"`
+	NotesDir          string `desc:"Folder release notes are saved to (default ~/Desktop)"`
+	NotesMarkdown     string `desc:"Path to a custom Markdown release notes template"`
+	NotesText         string `desc:"Path to a custom plain-text release notes template"`
+	WikiFormat        string `desc:"Wiki text formatting, textile (default) or markdown"`
+	DownloadDir       string `desc:"Folder attachments are downloaded to (default ~/Downloads)"`
+	NestSubtasks      bool   `desc:"If true, list subtasks under their parents in project issue lists"`
+	MergeProfiles     bool   `desc:"If true, list the issues from all profiles together"`
+	LogLevel          string `desc:"Logging: off, info (default), debug or trace"`
+	Timeout           int    `desc:"Seconds to wait for the server before showing cached data (default 10)"`
+	MaxRetries        int    `desc:"Times to retry a request when the server is busy or unreachable (default 3, -1 to never retry)"`
+	CacheTTLs         string `desc:"Cache lifetimes in minutes, e.g. issues=5,projects=120 (user, statuses, projects, time, issues, wiki)"`
+	CredentialStore   string `desc:"Where API keys are kept: file (default, encrypted) or command"`
+	CredentialCommand string `desc:"Command that prints the API key when CredentialStore is command, e.g. pass show redmine"`
+	Profile           string
+	Profiles          []profile
 }
-var cache struct {
-	Time          time.Time
+
+type cacheData struct {
+	Times         map[string]time.Time
+	FullSyncTime  time.Time
 	User          User
 	Issues        []Issue
+	RelatedIssues []Issue
 	IssueStatuses []IssueStatus
 	Projects      []Project
 	TimeEntries   []TimeEntry
-}
+	WikiPages     []WikiPage
+
+	// issues that time entries refer to but that can't be seen
+	UnavailableIssues map[int]bool
 
-var dlog = log.New(os.Stderr, "[redmine] ", log.LstdFlags)
+	// projects whose detail lists have been shown recently
+	ProjectDetails []projectDetails
+}
 
 func main() {
+	log.SetOutput(levelWriter{logInfo})
+
 	var err error
 	if workflow, err = alfred.OpenWorkflow(".", true); err != nil {
 		fmt.Printf("Error: %s", err)
 		os.Exit(1)
 	}
 
+	logFile = path.Join(workflow.CacheDir(), "redmine.log")
 	configFile = path.Join(workflow.DataDir(), "config.json")
-	cacheFile = path.Join(workflow.CacheDir(), "cache.json")
-
-	log.Println("Using config file", configFile)
-	log.Println("Using cache file", cacheFile)
 
 	if err := alfred.LoadJSON(configFile, &config); err != nil {
 		log.Println("Error loading config:", err)
 	}
 
-	if err := alfred.LoadJSON(cacheFile, &cache); err != nil {
-		log.Println("Error loading cache:", err)
+	addSecret(config.APIKey)
+	for _, p := range config.Profiles {
+		addSecret(p.APIKey)
 	}
 
-	AllowSelfSignedCert(config.AllowSelfSigned)
+	log.Println("Using config file", configFile)
+
+	migrateConfig()
+	loadCredentials()
+	OnUnauthorized = markExpired
+	if config.MaxRetries != 0 {
+		Retries.MaxRetries = config.MaxRetries
+	}
+
+	if p, ok := getProfile(config.Profile); ok {
+		useProfile(p)
+	} else {
+		useProfile(profile{})
+	}
+
+	// actions replace this deadline with a longer one of their own
+	ctx, cancel := context.WithTimeout(context.Background(), getTimeout())
+	defer cancel()
+	commandCtx = ctx
+
+	// a stale cache is refreshed by another copy of the workflow running in
+	// the background
+	if len(os.Args) == 4 && os.Args[1] == refreshFlag {
+		if p, ok := getProfile(os.Args[2]); ok {
+			useProfile(p)
+		}
+		runBackgroundRefresh(strings.Split(os.Args[3], ","))
+		return
+	}
 
-	workflow.Run([]alfred.Command{
+	runWorkflow([]alfred.Command{
 		IssuesCommand{},
 		ProjectsCommand{},
 		TimesheetCommand{},
+		ReleaseNotesCommand{},
+		WikiCommand{},
 		SyncCommand{},
 		OptionsCommand{},
+		ProfilesCommand{},
 		LoginCommand{},
 		LogoutCommand{},
 	})
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// This is a deliberately small renderer for Redmine's Textile and Markdown
+// wiki formatting. It handles headings, lists, code blocks and the common
+// inline styles, which is enough for a readable Quick Look preview; anything
+// it doesn't understand is shown as plain text.
+
+const wikiPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font: 14px -apple-system, Helvetica, sans-serif; margin: 2em; line-height: 1.4; }
+pre, code { font-family: Menlo, monospace; background: #f4f4f4; }
+pre { padding: 0.5em; overflow-x: auto; }
+.meta { color: #888; }
+</style>
+</head>
+<body>
+<p class="meta">%s</p>
+%s
+</body>
+</html>
+`
+
+var (
+	textileHeading = regexp.MustCompile(`^h([1-6])\.\s+(.*)$`)
+	textileBullet  = regexp.MustCompile(`^(\*+)\s+(.*)$`)
+	textileNumber  = regexp.MustCompile(`^(#+)\s+(.*)$`)
+	textileLink    = regexp.MustCompile(`&#34;(.+?)&#34;:(\S*[^\s.,;:!?)])`)
+	textileBold    = regexp.MustCompile(`\*([^*\s][^*]*)\*`)
+	textileItalic  = regexp.MustCompile(`\b_([^_\s][^_]*)_\b`)
+	textileCode    = regexp.MustCompile(`@([^@\s][^@]*)@`)
+
+	markdownHeading = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	markdownBullet  = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	markdownNumber  = regexp.MustCompile(`^\s*\d+\.\s+(.*)$`)
+	markdownLink    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	markdownBold    = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	markdownItalic  = regexp.MustCompile(`(^|[^*\w])[*_]([^*_\s][^*_]*)[*_]`)
+	markdownCode    = regexp.MustCompile("`([^`]+)`")
+)
+
+// renderWikiPage renders a wiki page as a complete HTML document.
+func renderWikiPage(page WikiPage, format string) string {
+	var body string
+	if strings.ToLower(format) == "markdown" {
+		body = renderMarkdown(page.Text)
+	} else {
+		body = renderTextile(page.Text)
+	}
+
+	meta := page.Project.Name
+	if page.Author.Name != "" {
+		meta += fmt.Sprintf(" — version %d by %s", page.Version, page.Author.Name)
+	}
+
+	return fmt.Sprintf(wikiPageHTML, html.EscapeString(page.Title), html.EscapeString(meta), body)
+}
+
+// markupWriter accumulates rendered blocks, tracking the open paragraph or
+// list so that it can be closed when a different kind of block starts.
+type markupWriter struct {
+	buf     bytes.Buffer
+	openTag string
+}
+
+func (w *markupWriter) open(tag string) {
+	if w.openTag == tag {
+		return
+	}
+	w.close()
+	if tag != "" {
+		w.buf.WriteString("<" + tag + ">\n")
+	}
+	w.openTag = tag
+}
+
+func (w *markupWriter) close() {
+	if w.openTag != "" {
+		w.buf.WriteString("</" + w.openTag + ">\n")
+		w.openTag = ""
+	}
+}
+
+func (w *markupWriter) line(s string) {
+	w.buf.WriteString(s + "\n")
+}
+
+func (w *markupWriter) String() string {
+	w.close()
+	return w.buf.String()
+}
+
+func renderTextile(text string) string {
+	var w markupWriter
+	inPre := false
+
+	for _, line := range splitLines(text) {
+		trimmed := strings.TrimSpace(line)
+
+		if inPre {
+			if strings.HasPrefix(trimmed, "</pre>") {
+				w.line("</pre>")
+				inPre = false
+			} else {
+				w.line(html.EscapeString(line))
+			}
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "<pre>") {
+			w.close()
+			w.line("<pre>")
+			inPre = true
+			continue
+		}
+
+		if trimmed == "" {
+			w.close()
+		} else if m := textileHeading.FindStringSubmatch(trimmed); m != nil {
+			w.close()
+			w.line(fmt.Sprintf("<h%s>%s</h%s>", m[1], textileInline(m[2]), m[1]))
+		} else if m := textileBullet.FindStringSubmatch(trimmed); m != nil {
+			w.open("ul")
+			w.line("<li>" + textileInline(m[2]) + "</li>")
+		} else if m := textileNumber.FindStringSubmatch(trimmed); m != nil {
+			w.open("ol")
+			w.line("<li>" + textileInline(m[2]) + "</li>")
+		} else {
+			w.open("p")
+			w.line(textileInline(trimmed) + "<br>")
+		}
+	}
+
+	if inPre {
+		w.line("</pre>")
+	}
+
+	return w.String()
+}
+
+func textileInline(s string) string {
+	s = html.EscapeString(s)
+	s = textileCode.ReplaceAllString(s, "<code>$1</code>")
+	s = textileLink.ReplaceAllString(s, `<a href="$2">$1</a>`)
+	s = textileBold.ReplaceAllString(s, "<strong>$1</strong>")
+	s = textileItalic.ReplaceAllString(s, "<em>$1</em>")
+	return s
+}
+
+func renderMarkdown(text string) string {
+	var w markupWriter
+	inPre := false
+
+	for _, line := range splitLines(text) {
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			if inPre {
+				w.line("</pre>")
+			} else {
+				w.close()
+				w.line("<pre>")
+			}
+			inPre = !inPre
+			continue
+		}
+
+		if inPre {
+			w.line(html.EscapeString(line))
+			continue
+		}
+
+		if trimmed == "" {
+			w.close()
+		} else if m := markdownHeading.FindStringSubmatch(trimmed); m != nil {
+			w.close()
+			level := len(m[1])
+			w.line(fmt.Sprintf("<h%d>%s</h%d>", level, markdownInline(m[2]), level))
+		} else if m := markdownBullet.FindStringSubmatch(line); m != nil {
+			w.open("ul")
+			w.line("<li>" + markdownInline(m[1]) + "</li>")
+		} else if m := markdownNumber.FindStringSubmatch(line); m != nil {
+			w.open("ol")
+			w.line("<li>" + markdownInline(m[1]) + "</li>")
+		} else {
+			w.open("p")
+			w.line(markdownInline(trimmed))
+		}
+	}
+
+	if inPre {
+		w.line("</pre>")
+	}
+
+	return w.String()
+}
+
+func markdownInline(s string) string {
+	s = html.EscapeString(s)
+	s = markdownCode.ReplaceAllString(s, "<code>$1</code>")
+	s = markdownLink.ReplaceAllString(s, `<a href="$2">$1</a>`)
+	s = markdownBold.ReplaceAllString(s, "<strong>$1</strong>")
+	s = markdownItalic.ReplaceAllString(s, "$1<em>$2</em>")
+	return s
+}
+
+func splitLines(text string) []string {
+	return strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+}
@@ -19,7 +19,7 @@ func (c OptionsCommand) About() alfred.CommandDef {
 	return alfred.CommandDef{
 		Keyword:     "options",
 		Description: "Sets options",
-		IsEnabled:   config.APIKey != "",
+		IsEnabled:   true,
 	}
 }
 
@@ -58,13 +58,8 @@ func (c OptionsCommand) Items(arg, data string) (items []alfred.Item, err error)
 				item.Title += " (press Enter to toggle)"
 			}
 
-			// copy the current options, update them, and use as the arg
-			opts := config
-			o := reflect.Indirect(reflect.ValueOf(&opts))
-			newVal := !f.Bool()
-			o.FieldByName(field.Name).SetBool(newVal)
 			item.Arg = itemArg
-			item.Arg.Data = alfred.Stringify(optionsCfg{NewConfig: &opts})
+			item.Arg.Data = alfred.Stringify(optionsCfg{Option: field.Name, Value: strconv.FormatBool(!f.Bool())})
 			item.AddCheckBox(f.Bool())
 		case "int":
 			item.Autocomplete += " "
@@ -75,13 +70,8 @@ func (c OptionsCommand) Items(arg, data string) (items []alfred.Item, err error)
 					return items, err
 				}
 				item.Title += fmt.Sprintf(": %d", val)
-
-				// copy the current options, update them, and use as the arg
-				opts := config
-				o := reflect.Indirect(reflect.ValueOf(&opts))
-				o.FieldByName(field.Name).SetInt(int64(val))
 				item.Arg = itemArg
-				item.Arg.Data = alfred.Stringify(optionsCfg{NewConfig: &opts})
+				item.Arg.Data = alfred.Stringify(optionsCfg{Option: field.Name, Value: strconv.Itoa(val)})
 			} else {
 				f := cfg.FieldByName(field.Name)
 				val := f.Int()
@@ -91,14 +81,56 @@ func (c OptionsCommand) Items(arg, data string) (items []alfred.Item, err error)
 				}
 			}
 		case "string":
-			f := cfg.FieldByName(field.Name)
+			if isSecret(field) {
+				// secrets are asked for when the item is actioned so that they
+				// never end up in an item arg
+				f := cfg.FieldByName(field.Name)
+				item.Title += ": " + maskSecret(field, f.String())
+				if name == field.Name {
+					item.Title += " (press Enter to change)"
+				}
+				item.Arg = itemArg
+				item.Arg.Data = alfred.Stringify(optionsCfg{Option: field.Name})
+				break
+			}
+
 			item.Autocomplete += " "
-			item.Title += ": " + f.String()
+
+			if value != "" {
+				item.Title += ": " + value
+				item.Arg = itemArg
+				item.Arg.Data = alfred.Stringify(optionsCfg{Option: field.Name, Value: value})
+			} else {
+				f := cfg.FieldByName(field.Name)
+				item.Title += ": " + maskSecret(field, f.String())
+				if name == field.Name {
+					item.Title += " (type a new value to change)"
+				}
+			}
 		}
 
 		items = append(items, item)
 	}
 
+	if clientError != nil {
+		items = append(items, alfred.Item{
+			Title:    "Connection settings can't be used",
+			Subtitle: clientError.Error(),
+		})
+	}
+
+	if alfred.FuzzyMatches("show log", arg) {
+		items = append(items, alfred.Item{
+			Title:    "Show log",
+			Subtitle: fmt.Sprintf("Open the workflow log (level: %s)", logLevelNames[getLogLevel()]),
+			Arg: &alfred.ItemArg{
+				Keyword: "options",
+				Mode:    alfred.ModeDo,
+				Data:    alfred.Stringify(optionsCfg{ToOpen: logFile}),
+			},
+		})
+	}
+
 	if latest, available := workflow.UpdateAvailable(); available {
 		items = append(items, alfred.Item{
 			Title:    fmt.Sprintf("Update: An update is available: %v", latest.Version),
@@ -132,8 +164,30 @@ func (c OptionsCommand) Do(data string) (out string, err error) {
 		err = exec.Command("open", cfg.ToOpen).Run()
 	}
 
-	if cfg.NewConfig != nil {
-		if err = alfred.SaveJSON(configFile, cfg.NewConfig); err != nil {
+	if cfg.Option != "" {
+		field, ok := reflect.TypeOf(config).FieldByName(cfg.Option)
+		if !ok || field.Tag.Get("desc") == "" {
+			return "", fmt.Errorf("Unknown option %s", cfg.Option)
+		}
+
+		value := cfg.Value
+		if isSecret(field) {
+			var btn string
+			if btn, value, err = workflow.GetInput(field.Name, "", true); err != nil {
+				return
+			}
+			if btn != "Ok" {
+				dlog.Println("User didn't click OK")
+				return
+			}
+		}
+
+		// saveConfig copies server settings into the active profile and keeps
+		// credentials out of the config file
+		if err = setOption(cfg.Option, value); err == nil {
+			err = saveConfig()
+		}
+		if err != nil {
 			log.Printf("Error saving config: %s\n", err)
 			return "Error updating options", err
 		}
@@ -142,7 +196,45 @@ func (c OptionsCommand) Do(data string) (out string, err error) {
 	return "Updated options", err
 }
 
+// setOption parses value into the named config option.
+func setOption(name, value string) error {
+	f := reflect.Indirect(reflect.ValueOf(&config)).FieldByName(name)
+	switch f.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(i))
+	case reflect.String:
+		f.SetString(value)
+	default:
+		return fmt.Errorf("Option %s can't be set", name)
+	}
+	return nil
+}
+
+// isSecret returns true for options tagged as secret.
+func isSecret(field reflect.StructField) bool {
+	return field.Tag.Get("secret") == "true"
+}
+
+// maskSecret hides the value of options tagged as secret.
+func maskSecret(field reflect.StructField, value string) string {
+	if isSecret(field) && value != "" {
+		return "*****"
+	}
+	return value
+}
+
 type optionsCfg struct {
-	NewConfig interface{}
-	ToOpen    string
+	Option string
+	Value  string
+	ToOpen string
 }
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/jason0x43/go-alfred"
+)
+
+// ProfilesCommand is a command
+type ProfilesCommand struct{}
+
+// About returns information about a command
+func (c ProfilesCommand) About() alfred.CommandDef {
+	return alfred.CommandDef{
+		Keyword:     profilesKeyword,
+		Description: "Switch between Redmine servers",
+		IsEnabled:   len(config.Profiles) > 0,
+	}
+}
+
+// Items returns a list of filter items
+func (c ProfilesCommand) Items(arg, data string) (items []alfred.Item, err error) {
+	for _, p := range config.Profiles {
+		if !alfred.FuzzyMatches(p.Name, arg) {
+			continue
+		}
+
+		item := alfred.Item{
+			UID:          "redmineprofile-" + p.Name,
+			Title:        p.Name,
+			Subtitle:     p.RedmineURL,
+			Autocomplete: p.Name,
+			Arg: &alfred.ItemArg{
+				Keyword: profilesKeyword,
+				Mode:    alfred.ModeDo,
+				Data:    alfred.Stringify(&profileCfg{ToUse: p.Name}),
+			},
+		}
+		item.AddCheckBox(p.Name == config.Profile)
+		items = append(items, item)
+	}
+
+	items = append(items, alfred.Item{
+		Title:    "Add a profile",
+		Subtitle: "Log in to another Redmine server",
+		Arg: &alfred.ItemArg{
+			Keyword: "login",
+			Mode:    alfred.ModeDo,
+		},
+	})
+
+	return
+}
+
+// Do runs the command
+func (c ProfilesCommand) Do(data string) (out string, err error) {
+	var cfg profileCfg
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+			return "", fmt.Errorf("Invalid profile config")
+		}
+	}
+
+	if cfg.ToUse != "" {
+		p, ok := getProfile(cfg.ToUse)
+		if !ok {
+			return "", fmt.Errorf("Unknown profile %s", cfg.ToUse)
+		}
+
+		useProfile(p)
+		if err = saveConfig(); err != nil {
+			return
+		}
+
+		out = "Switched to " + p.Name
+	}
+
+	return
+}
+
+// support -------------------------------------------------------------------
+
+const profilesKeyword = "profiles"
+
+type profileCfg struct {
+	ToUse string
+}
+
+// A profile holds the settings for one Redmine server. The active profile's
+// settings are mirrored in the top level of the config.
+type profile struct {
+	Name            string
+	RedmineURL      string
+	APIKey          string
+	AllowSelfSigned bool
+	CAFile          string
+	PinnedKeys      string
+	ClientCert      string
+	ClientKey       string
+	Proxy           string
+	Headers         string
+	GatewayUser     string
+	GatewayPassword string
+	Expired         bool
+}
+
+func getProfile(name string) (p profile, ok bool) {
+	for _, p = range config.Profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return
+}
+
+// addProfile adds a profile to the config, replacing any existing profile
+// with the same name.
+func addProfile(p profile) {
+	for i := range config.Profiles {
+		if config.Profiles[i].Name == p.Name {
+			config.Profiles[i] = p
+			return
+		}
+	}
+	config.Profiles = append(config.Profiles, p)
+}
+
+func removeProfile(name string) {
+	var profiles []profile
+	for _, p := range config.Profiles {
+		if p.Name != name {
+			profiles = append(profiles, p)
+		}
+	}
+	config.Profiles = profiles
+}
+
+// useProfile makes a profile the active one, loading its cache. An unnamed
+// profile leaves the current server settings alone.
+func useProfile(p profile) {
+	if p.Name != "" {
+		setActiveProfile(p)
+	}
+
+	loadCache(p.Name)
+	configureClient()
+}
+
+// setActiveProfile copies a profile's settings into the top level of the
+// config.
+func setActiveProfile(p profile) {
+	config.Profile = p.Name
+	config.RedmineURL = p.RedmineURL
+	config.APIKey = p.APIKey
+	config.AllowSelfSigned = p.AllowSelfSigned
+	config.CAFile = p.CAFile
+	config.PinnedKeys = p.PinnedKeys
+	config.ClientCert = p.ClientCert
+	config.ClientKey = p.ClientKey
+	config.Proxy = p.Proxy
+	config.Headers = p.Headers
+	config.GatewayUser = p.GatewayUser
+	config.GatewayPassword = p.GatewayPassword
+}
+
+// clientError is set if the active profile's connection settings couldn't be
+// applied
+var clientError error
+
+// configureClient sets up connections using the active server settings.
+func configureClient() {
+	if clientError = configureClientFor(activeProfile()); clientError != nil {
+		log.Println("Error configuring connections:", clientError)
+	}
+}
+
+// configureClientFor sets up connections using a profile's server settings.
+func configureClientFor(p profile) error {
+	var pins []string
+	for _, pin := range strings.Split(p.PinnedKeys, ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+
+	return ConfigureClient(ClientOptions{
+		TLSOptions: TLSOptions{
+			AllowSelfSigned: p.AllowSelfSigned,
+			CAFile:          expandPath(p.CAFile),
+			PinnedKeys:      pins,
+			ClientCert:      expandPath(p.ClientCert),
+			ClientKey:       expandPath(p.ClientKey),
+		},
+		Proxy: strings.TrimSpace(p.Proxy),
+	})
+}
+
+// openSession opens a session for the active profile.
+func openSession() Session {
+	return newSession(activeProfile())
+}
+
+// newSession opens a session for a profile's server using its API key,
+// gateway and header settings.
+func newSession(p profile) Session {
+	session := OpenSession(p.RedmineURL, p.APIKey)
+	if p.GatewayUser != "" {
+		session.SetGateway(p.GatewayUser, p.GatewayPassword)
+	}
+	session.SetHeaders(parseHeaders(p.Headers))
+	return session
+}
+
+// activeProfile returns the active server settings as a profile.
+func activeProfile() profile {
+	return profile{
+		Name:            config.Profile,
+		RedmineURL:      config.RedmineURL,
+		APIKey:          config.APIKey,
+		AllowSelfSigned: config.AllowSelfSigned,
+		CAFile:          config.CAFile,
+		PinnedKeys:      config.PinnedKeys,
+		ClientCert:      config.ClientCert,
+		ClientKey:       config.ClientKey,
+		Proxy:           config.Proxy,
+		Headers:         config.Headers,
+		GatewayUser:     config.GatewayUser,
+		GatewayPassword: config.GatewayPassword,
+	}
+}
+
+// parseHeaders reads a list of headers like "X-Team: infra; X-Env: prod".
+func parseHeaders(headers string) map[string]string {
+	parsed := map[string]string{}
+	for _, header := range strings.Split(headers, ";") {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			if strings.TrimSpace(header) != "" {
+				log.Printf("Invalid header: %s", header)
+			}
+			continue
+		}
+		parsed[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return parsed
+}
+
+// withProfile temporarily switches to another profile while running fn.
+func withProfile(name string, fn func() error) error {
+	p, ok := getProfile(name)
+	if !ok {
+		return fmt.Errorf("Unknown profile %s", name)
+	}
+
+	savedConfig := config
+	savedCache := cache
+	savedStore := localStore
+
+	defer func() {
+		config = savedConfig
+		cache = savedCache
+		localStore = savedStore
+		configureClient()
+	}()
+
+	useProfile(p)
+	return fn()
+}
+
+// saveConfig copies the active server settings back into the active profile
+// and saves the config. The active API key is saved to the credential store;
+// the config file itself never contains API keys.
+func saveConfig() error {
+	for i := range config.Profiles {
+		if config.Profiles[i].Name == config.Profile {
+			config.Profiles[i].RedmineURL = config.RedmineURL
+			config.Profiles[i].APIKey = config.APIKey
+			config.Profiles[i].AllowSelfSigned = config.AllowSelfSigned
+			config.Profiles[i].CAFile = config.CAFile
+			config.Profiles[i].PinnedKeys = config.PinnedKeys
+			config.Profiles[i].ClientCert = config.ClientCert
+			config.Profiles[i].ClientKey = config.ClientKey
+			config.Profiles[i].Proxy = config.Proxy
+			config.Profiles[i].Headers = config.Headers
+			config.Profiles[i].GatewayUser = config.GatewayUser
+			config.Profiles[i].GatewayPassword = config.GatewayPassword
+		}
+	}
+
+	if config.Profile != "" && config.APIKey != "" {
+		if err := getCredentialStore().Set(config.Profile, config.APIKey); err != nil {
+			return err
+		}
+	}
+	if config.Profile != "" && config.GatewayPassword != "" {
+		if err := getCredentialStore().Set(gatewayCredential(config.Profile), config.GatewayPassword); err != nil {
+			return err
+		}
+	}
+
+	saved := withoutCredentials()
+	return alfred.SaveJSON(configFile, &saved)
+}
+
+// withoutCredentials returns a copy of the config with all API keys and
+// gateway passwords removed.
+func withoutCredentials() (c configData) {
+	c = config
+	c.APIKey = ""
+	c.GatewayPassword = ""
+	c.Profiles = make([]profile, len(config.Profiles))
+	for i, p := range config.Profiles {
+		p.APIKey = ""
+		p.GatewayPassword = ""
+		c.Profiles[i] = p
+	}
+	return
+}
+
+// isLoggedIn returns true if there's an API key for the active profile that
+// the server hasn't rejected.
+func isLoggedIn() bool {
+	return config.APIKey != "" && !isExpired()
+}
+
+// isExpired returns true if the server has rejected the active profile's API
+// key.
+func isExpired() bool {
+	p, ok := getProfile(config.Profile)
+	return ok && p.Expired
+}
+
+// expiredLock serializes markExpired, which is called from the goroutines
+// making a command's requests
+var expiredLock sync.Mutex
+
+// markExpired flags the profiles using an API key as needing a new login. The
+// flag is saved straight to the config file since this may happen while
+// another profile is temporarily active.
+func markExpired(apiKey string) {
+	expiredLock.Lock()
+	defer expiredLock.Unlock()
+
+	var names []string
+	for i := range config.Profiles {
+		p := &config.Profiles[i]
+		if p.APIKey == apiKey && !p.Expired {
+			p.Expired = true
+			names = append(names, p.Name)
+			log.Printf("API key for profile %s was rejected", p.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		return
+	}
+
+	var saved configData
+	if err := alfred.LoadJSON(configFile, &saved); err != nil {
+		log.Println("Error loading config:", err)
+		return
+	}
+	for i := range saved.Profiles {
+		for _, name := range names {
+			if saved.Profiles[i].Name == name {
+				saved.Profiles[i].Expired = true
+			}
+		}
+	}
+	if err := alfred.SaveJSON(configFile, &saved); err != nil {
+		log.Println("Error saving config:", err)
+	}
+}
+
+// migrateConfig turns the single server login from older versions into a
+// profile.
+func migrateConfig() {
+	if len(config.Profiles) > 0 || config.APIKey == "" {
+		return
+	}
+
+	p := activeProfile()
+	p.Name = getDefaultProfileName(config.RedmineURL)
+	addProfile(p)
+	config.Profile = p.Name
+
+	log.Println("Migrated login to profile", p.Name)
+	if err := saveConfig(); err != nil {
+		log.Println("Error saving config:", err)
+	}
+}
+
+func getDefaultProfileName(redmineURL string) string {
+	if u, err := url.Parse(redmineURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "default"
+}
+
+// getCacheFile returns the single-file cache used by older versions.
+func getCacheFile(name string) string {
+	if name == "" {
+		return path.Join(workflow.CacheDir(), "cache.json")
+	}
+	return path.Join(workflow.CacheDir(), "cache-"+toFileName(name)+".json")
+}
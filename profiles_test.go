@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jason0x43/go-alfred"
+)
+
+func TestMarkExpiredConcurrently(t *testing.T) {
+	savedConfig, savedConfigFile := config, configFile
+	defer func() { config, configFile = savedConfig, savedConfigFile }()
+
+	configFile = filepath.Join(t.TempDir(), "config.json")
+	config = configData{Profiles: []profile{
+		{Name: "one", APIKey: "key"},
+		{Name: "two", APIKey: "other"},
+	}}
+	if err := alfred.SaveJSON(configFile, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	// every request of a refresh may be rejected at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			markExpired("key")
+		}()
+	}
+	wg.Wait()
+
+	var saved configData
+	if err := alfred.LoadJSON(configFile, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Profiles[0].Expired || saved.Profiles[1].Expired {
+		t.Errorf("saved profiles %+v, want only the first expired", saved.Profiles)
+	}
+}
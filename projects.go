@@ -3,7 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"os/exec"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jason0x43/go-alfred"
@@ -17,7 +20,7 @@ func (c ProjectsCommand) About() alfred.CommandDef {
 	return alfred.CommandDef{
 		Keyword:     projectsKeyword,
 		Description: "List the projects you're working on",
-		IsEnabled:   config.APIKey != "",
+		IsEnabled:   isLoggedIn(),
 	}
 }
 
@@ -30,9 +33,21 @@ func (c ProjectsCommand) Items(arg, data string) (items []alfred.Item, err error
 		}
 	}
 
-	if err = checkRefresh(); err != nil {
+	if err = checkRefresh(resUser, resStatuses, resProjects, resIssues); err != nil {
 		return
 	}
+	defer func() { items = append(cacheStatusItems(arg), items...) }()
+
+	if cfg.ProjectID != nil {
+		if cfg.ListIssues {
+			return createProjectIssueItems(arg, *cfg.ProjectID)
+		}
+		return createProjectDetailItems(arg, *cfg.ProjectID)
+	}
+
+	if cfg.All {
+		return createAllProjectItems(arg), nil
+	}
 
 	// first, filter all projects based on user's open issues
 	projects := map[int]Issue{}
@@ -57,12 +72,12 @@ func (c ProjectsCommand) Items(arg, data string) (items []alfred.Item, err error
 
 	// First, add the projects with active issues
 	for _, project := range cache.Projects {
-		if _, ok := activeProjects[project.ID]; !ok {
+		if _, ok := activeProjects[project.ID]; !ok || !isProjectOpen(project) {
 			// skip inactive projects
 			continue
 		}
 
-		if p, ok := projects[project.ID]; ok && alfred.FuzzyMatches(project.Name, arg) {
+		if p, ok := projects[project.ID]; ok && projectMatches(project, arg) {
 			subTitle := fmt.Sprintf("%d issues", issueCounts[project.ID])
 			if p.DueDate != "" {
 				dueDate, _ := time.Parse("2006-01-02", p.DueDate)
@@ -71,12 +86,12 @@ func (c ProjectsCommand) Items(arg, data string) (items []alfred.Item, err error
 
 			item := alfred.Item{
 				UID:          fmt.Sprintf("redmineproject-%d", project.ID),
-				Title:        project.Name,
+				Title:        getProjectPath(project),
 				Autocomplete: project.Name,
 				Subtitle:     subTitle,
 				Arg: &alfred.ItemArg{
 					Keyword: issuesKeyword,
-					Data:    alfred.Stringify(&issueCfg{ProjectID: &project.ID}),
+					Data:    stringifyIssueCfg(issueCfg{ProjectID: &project.ID}),
 				},
 			}
 
@@ -95,19 +110,19 @@ func (c ProjectsCommand) Items(arg, data string) (items []alfred.Item, err error
 
 	// Next, add the projects that recently had active issues
 	for _, project := range cache.Projects {
-		if _, ok := activeProjects[project.ID]; ok {
+		if _, ok := activeProjects[project.ID]; ok || !isProjectOpen(project) {
 			// skip active projects
 			continue
 		}
 
-		if _, ok := projects[project.ID]; ok && alfred.FuzzyMatches(project.Name, arg) {
+		if _, ok := projects[project.ID]; ok && projectMatches(project, arg) {
 			item := alfred.Item{
 				UID:          fmt.Sprintf("redmineproject-%d", project.ID),
-				Title:        project.Name,
+				Title:        getProjectPath(project),
 				Autocomplete: project.Name,
 				Arg: &alfred.ItemArg{
 					Keyword: issuesKeyword,
-					Data:    alfred.Stringify(&issueCfg{ProjectID: &project.ID}),
+					Data:    stringifyIssueCfg(issueCfg{ProjectID: &project.ID}),
 				},
 			}
 
@@ -124,11 +139,26 @@ func (c ProjectsCommand) Items(arg, data string) (items []alfred.Item, err error
 		}
 	}
 
+	// Finally, offer to browse all projects
+	if alfred.FuzzyMatches("all projects", arg) {
+		items = append(items, alfred.Item{
+			Title:        "All projects",
+			Subtitle:     "Browse all the projects you can see",
+			Autocomplete: "all projects",
+			Arg: &alfred.ItemArg{
+				Keyword: projectsKeyword,
+				Data:    alfred.Stringify(&projectCfg{All: true}),
+			},
+		})
+	}
+
 	return
 }
 
 // Do runs the command
 func (c ProjectsCommand) Do(data string) (out string, err error) {
+	defer startAction()()
+
 	var cfg projectCfg
 	if data != "" {
 		if err := json.Unmarshal([]byte(data), &cfg); err != nil {
@@ -140,6 +170,33 @@ func (c ProjectsCommand) Do(data string) (out string, err error) {
 		err = exec.Command("open", cfg.ToOpen).Run()
 	}
 
+	if cfg.ToCreate != nil {
+		session := openSession()
+
+		var created Issue
+		if created, err = createIssue(&session, *cfg.ToCreate); err != nil {
+			return
+		}
+
+		out = fmt.Sprintf("Created issue %d", created.ID)
+	}
+
+	if cfg.ToLog != nil {
+		session := openSession()
+
+		var entry TimeEntry
+		if entry, err = session.CreateTimeEntryContext(commandCtx, *cfg.ToLog); err != nil {
+			return
+		}
+
+		cache.TimeEntries = append(cache.TimeEntries, entry)
+		if err := saveCache(); err != nil {
+			log.Printf("Error saving cache: %v\n", err)
+		}
+
+		out = fmt.Sprintf("Logged %.2f hours", entry.Hours)
+	}
+
 	return
 }
 
@@ -148,11 +205,417 @@ func (c ProjectsCommand) Do(data string) (out string, err error) {
 const projectsKeyword = "projects"
 
 type projectCfg struct {
-	ProjectID *int
-	ToOpen    string
+	ProjectID  *int
+	All        bool
+	ListIssues bool
+	ToOpen     string
+	ToCreate   *UpdateIssue
+	ToLog      *UpdateTimeEntry
+}
+
+func createAllProjectItems(arg string) (items []alfred.Item) {
+	for _, project := range cache.Projects {
+		if !isProjectOpen(project) || !projectMatches(project, arg) {
+			continue
+		}
+
+		pid := project.ID
+		subTitle := project.Identifier
+		if desc := firstLine(project.Description); desc != "" {
+			subTitle += ": " + desc
+		}
+
+		item := alfred.Item{
+			UID:          fmt.Sprintf("redmineproject-%d", project.ID),
+			Title:        getProjectPath(project),
+			Subtitle:     subTitle,
+			Autocomplete: project.Name,
+			Arg: &alfred.ItemArg{
+				Keyword: projectsKeyword,
+				Data:    alfred.Stringify(&projectCfg{ProjectID: &pid}),
+			},
+		}
+
+		item.AddMod(alfred.ModCmd, alfred.ItemMod{
+			Subtitle: "Open this project in Redmine",
+			Arg: &alfred.ItemArg{
+				Keyword: projectsKeyword,
+				Mode:    alfred.ModeDo,
+				Data:    alfred.Stringify(&projectCfg{ToOpen: getProjectURL(project.ID)}),
+			},
+		})
+
+		items = append(items, item)
+	}
+
+	if len(items) == 0 {
+		items = append(items, alfred.Item{Title: "No projects"})
+	}
+
+	return
+}
+
+// projectDetailsTTL is how long a project's details are reused for; they're
+// loaded when its detail list is opened, and reused while the list is filtered
+const projectDetailsTTL = 5 * time.Minute
+
+// projectDetails holds the parts of a project's detail list that come from
+// the server.
+type projectDetails struct {
+	Project     Project
+	Memberships []Membership
+	Versions    []Version
+	Time        time.Time
+}
+
+// getProjectDetails returns a project's details, loading them from the server
+// if they aren't cached or are out of date.
+func getProjectDetails(pid int) (details projectDetails, err error) {
+	idx := -1
+	for i := range cache.ProjectDetails {
+		if cache.ProjectDetails[i].Project.ID == pid {
+			idx = i
+		}
+	}
+	if idx != -1 && time.Now().Sub(cache.ProjectDetails[idx].Time) < projectDetailsTTL {
+		return cache.ProjectDetails[idx], nil
+	}
+
+	session := openSession()
+	details.Time = time.Now()
+
+	if details.Project, err = session.GetProjectContext(commandCtx, pid); err != nil {
+		if !isTimeout(err) {
+			return
+		}
+
+		// show what's known while the server is slow
+		serverSlow = true
+		if idx != -1 {
+			return cache.ProjectDetails[idx], nil
+		}
+		if pidx := indexOfByID(projectList(cache.Projects), pid); pidx != -1 {
+			return projectDetails{Project: cache.Projects[pidx]}, nil
+		}
+		return
+	}
+
+	// members and versions may not be visible to everyone
+	var merr, verr error
+	if details.Memberships, merr = session.GetMembershipsContext(commandCtx, pid); merr != nil {
+		log.Printf("Error getting memberships: %v", merr)
+	}
+	if details.Versions, verr = session.GetVersionsContext(commandCtx, pid); verr != nil {
+		log.Printf("Error getting versions: %v", verr)
+	}
+
+	// out of date details for other projects are dropped along the way
+	fresh := []projectDetails{details}
+	for _, d := range cache.ProjectDetails {
+		if d.Project.ID != pid && time.Now().Sub(d.Time) < projectDetailsTTL {
+			fresh = append(fresh, d)
+		}
+	}
+	cache.ProjectDetails = fresh
+	if err := saveCache(); err != nil {
+		log.Printf("Error saving cache: %v\n", err)
+	}
+
+	return
+}
+
+func createProjectDetailItems(arg string, pid int) (items []alfred.Item, err error) {
+	var details projectDetails
+	if details, err = getProjectDetails(pid); err != nil {
+		return
+	}
+	project := details.Project
+	memberships := details.Memberships
+	versions := details.Versions
+
+	parts := alfred.CleanSplitN(arg, " ", 2)
+
+	if arg == "" {
+		items = append(items, alfred.Item{
+			Title:    getProjectPath(project),
+			Subtitle: firstLine(project.Description),
+			Arg: &alfred.ItemArg{
+				Keyword: projectsKeyword,
+				Mode:    alfred.ModeDo,
+				Data:    alfred.Stringify(&projectCfg{ToOpen: getProjectURL(pid)}),
+			},
+		})
+	}
+
+	if project.Homepage != "" && alfred.FuzzyMatches("homepage:", parts[0]) {
+		items = append(items, alfred.Item{
+			Title: "Homepage: " + project.Homepage,
+			Arg: &alfred.ItemArg{
+				Keyword: projectsKeyword,
+				Mode:    alfred.ModeDo,
+				Data:    alfred.Stringify(&projectCfg{ToOpen: project.Homepage}),
+			},
+		})
+	}
+
+	if alfred.FuzzyMatches("role:", parts[0]) {
+		// roles may be given to the user directly or through their groups
+		groups := map[int]bool{}
+		for _, group := range cache.User.Groups {
+			groups[group.ID] = true
+		}
+
+		var roles []string
+		hasRole := map[string]bool{}
+		for _, membership := range memberships {
+			if membership.User.ID == cache.User.ID || (membership.Group.ID != 0 && groups[membership.Group.ID]) {
+				for _, role := range membership.Roles {
+					if !hasRole[role.Name] {
+						hasRole[role.Name] = true
+						roles = append(roles, role.Name)
+					}
+				}
+			}
+		}
+
+		title := "My role: not a member"
+		if len(roles) > 0 {
+			title = "My role: " + strings.Join(roles, ", ")
+		}
+		items = append(items, alfred.Item{Title: title})
+	}
+
+	if alfred.FuzzyMatches("trackers:", parts[0]) {
+		var trackers []string
+		for _, tracker := range project.Trackers {
+			trackers = append(trackers, tracker.Name)
+		}
+		items = append(items, alfred.Item{Title: "Trackers: " + strings.Join(trackers, ", ")})
+	}
+
+	if alfred.FuzzyMatches("members:", parts[0]) {
+		if parts[0] == "Members:" {
+			for _, membership := range memberships {
+				name := membership.User.Name
+				if name == "" {
+					name = membership.Group.Name
+				}
+				if len(parts) == 2 && !alfred.FuzzyMatches(name, parts[1]) {
+					continue
+				}
+
+				var roles []string
+				for _, role := range membership.Roles {
+					roles = append(roles, role.Name)
+				}
+				items = append(items, alfred.Item{
+					Title:    name,
+					Subtitle: strings.Join(roles, ", "),
+				})
+			}
+		} else {
+			items = append(items, alfred.Item{
+				Title:        fmt.Sprintf("Members: %d", len(memberships)),
+				Autocomplete: "Members: ",
+			})
+		}
+	}
+
+	if alfred.FuzzyMatches("versions:", parts[0]) {
+		if parts[0] == "Versions:" {
+			for _, version := range versions {
+				if len(parts) == 2 && !alfred.FuzzyMatches(version.Name, parts[1]) {
+					continue
+				}
+
+				subTitle := version.Status
+				if version.DueDate != "" {
+					subTitle += ", due " + version.DueDate
+				}
+				items = append(items, alfred.Item{
+					Title:    version.Name,
+					Subtitle: subTitle,
+					Arg: &alfred.ItemArg{
+						Keyword: projectsKeyword,
+						Mode:    alfred.ModeDo,
+						Data:    alfred.Stringify(&projectCfg{ToOpen: fmt.Sprintf("%s/versions/%d", config.RedmineURL, version.ID)}),
+					},
+				})
+			}
+		} else {
+			items = append(items, alfred.Item{
+				Title:        fmt.Sprintf("Versions: %d", len(versions)),
+				Autocomplete: "Versions: ",
+			})
+		}
+	}
+
+	if alfred.FuzzyMatches("issues:", parts[0]) {
+		items = append(items, alfred.Item{
+			Title:    "Issues: list all open issues",
+			Subtitle: "Load the open issues in " + project.Name + " from Redmine",
+			Arg: &alfred.ItemArg{
+				Keyword: projectsKeyword,
+				Data:    alfred.Stringify(&projectCfg{ProjectID: &pid, ListIssues: true}),
+			},
+		})
+	}
+
+	if alfred.FuzzyMatches("new:", parts[0]) {
+		if parts[0] == "New:" && len(parts) == 2 {
+			for _, tracker := range project.Trackers {
+				items = append(items, alfred.Item{
+					Title:    fmt.Sprintf("New %s: %s", tracker.Name, parts[1]),
+					Subtitle: "Create an issue in " + project.Name,
+					Arg: &alfred.ItemArg{
+						Keyword: projectsKeyword,
+						Mode:    alfred.ModeDo,
+						Data: alfred.Stringify(&projectCfg{
+							ToCreate: &UpdateIssue{
+								Project:        pid,
+								Tracker:        tracker.ID,
+								Subject:        parts[1],
+								WatcherUserIDs: []int{cache.User.ID},
+							},
+						}),
+					},
+				})
+			}
+		} else {
+			items = append(items, alfred.Item{
+				Title:        "New: create an issue",
+				Subtitle:     "Type the subject of the new issue",
+				Autocomplete: "New: ",
+			})
+		}
+	}
+
+	if alfred.FuzzyMatches("log:", parts[0]) {
+		if parts[0] == "Log:" && len(parts) == 2 {
+			logParts := alfred.CleanSplitN(parts[1], " ", 2)
+			if hours, err := strconv.ParseFloat(logParts[0], 64); err == nil {
+				entry := UpdateTimeEntry{
+					Project: pid,
+					SpentOn: toIsoDateString(time.Now()),
+					Hours:   hours,
+				}
+				if len(logParts) == 2 {
+					entry.Comments = logParts[1]
+				}
+
+				items = append(items, alfred.Item{
+					Title:    fmt.Sprintf("Log %.2f hours in %s", hours, project.Name),
+					Subtitle: entry.Comments,
+					Arg: &alfred.ItemArg{
+						Keyword: projectsKeyword,
+						Mode:    alfred.ModeDo,
+						Data:    alfred.Stringify(&projectCfg{ToLog: &entry}),
+					},
+				})
+			}
+		} else {
+			items = append(items, alfred.Item{
+				Title:        "Log: log time",
+				Subtitle:     "Type the hours spent today, optionally followed by a comment",
+				Autocomplete: "Log: ",
+			})
+		}
+	}
+
+	return
+}
+
+func createProjectIssueItems(arg string, pid int) (items []alfred.Item, err error) {
+	session := openSession()
+
+	var issues []Issue
+	if issues, err = session.GetProjectIssuesContext(commandCtx, pid); err != nil {
+		if !isTimeout(err) {
+			return
+		}
+
+		// fall back to the project's open watched issues
+		closed := getClosedStatusIDs()
+		for _, issue := range cache.Issues {
+			if issue.Project.ID == pid && !closed[issue.Status.ID] {
+				issues = append(issues, issue)
+			}
+		}
+		serverSlow = true
+		err = nil
+	}
+
+	items = createIssueItems(arg, pid, issues)
+
+	if arg == "" {
+		title := "Project"
+		if idx := indexOfByID(projectList(cache.Projects), pid); idx != -1 {
+			title = getProjectPath(cache.Projects[idx])
+		}
+		item := alfred.Item{
+			Title:    title,
+			Subtitle: alfred.Line,
+			Arg: &alfred.ItemArg{
+				Keyword: projectsKeyword,
+				Data:    alfred.Stringify(&projectCfg{ProjectID: &pid}),
+			},
+		}
+		items = alfred.InsertItem(items, item, 0)
+	}
+
+	return
+}
+
+func firstLine(s string) string {
+	return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
 }
 
 func getProjectURL(pid int) string {
-	// return fmt.Sprintf("%s/projects/%v/issues", config.RedmineURL, pid)
-	return fmt.Sprintf("%s/projects/%v", config.RedmineURL, pid)
+	// return fmt.Sprintf("%s/projects/%v/issues", config.RedmineURL, getProjectSlug(pid))
+	return fmt.Sprintf("%s/projects/%v", config.RedmineURL, getProjectSlug(pid))
+}
+
+// getProjectSlug returns the identifier Redmine uses for a project in URLs,
+// falling back to the project's numeric ID if the project isn't cached.
+func getProjectSlug(pid int) string {
+	if idx := indexOfByID(projectList(cache.Projects), pid); idx != -1 && cache.Projects[idx].Identifier != "" {
+		return cache.Projects[idx].Identifier
+	}
+	return strconv.Itoa(pid)
+}
+
+// getProjectPath returns the name of a project prefixed by the names of its
+// ancestors, e.g. "Platform › API".
+func getProjectPath(project Project) string {
+	path := project.Name
+	seen := map[int]bool{project.ID: true}
+
+	for pid := project.Parent.ID; pid != 0 && !seen[pid]; {
+		seen[pid] = true
+
+		idx := indexOfByID(projectList(cache.Projects), pid)
+		if idx == -1 {
+			break
+		}
+
+		parent := cache.Projects[idx]
+		path = parent.Name + " › " + path
+		pid = parent.Parent.ID
+	}
+
+	return path
+}
+
+// isProjectOpen is true for projects that are neither closed nor archived.
+// Projects cached before the status was recorded are assumed to be open.
+func isProjectOpen(project Project) bool {
+	return project.Status == ProjectStatusActive || project.Status == 0
+}
+
+// projectMatches is true if a fuzzy query matches a project's name, its full
+// path, or its identifier.
+func projectMatches(project Project, query string) bool {
+	return alfred.FuzzyMatches(project.Name, query) ||
+		alfred.FuzzyMatches(getProjectPath(project), query) ||
+		alfred.FuzzyMatches(project.Identifier, query)
 }
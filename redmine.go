@@ -8,86 +8,242 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 var client = &http.Client{}
 
+// RetryPolicy controls how failed requests are retried. Delays grow
+// exponentially from BaseDelay up to MaxDelay, with random jitter. A
+// Retry-After time from the server is honoured, but if it's longer than
+// MaxRetryAfter the request isn't retried.
+type RetryPolicy struct {
+	MaxRetries    int
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	MaxRetryAfter time.Duration
+}
+
+// Retries is the retry policy used by all Sessions.
+var Retries = RetryPolicy{
+	MaxRetries:    3,
+	BaseDelay:     500 * time.Millisecond,
+	MaxDelay:      8 * time.Second,
+	MaxRetryAfter: 30 * time.Second,
+}
+
+// sleep waits between retries, returning early with an error if ctx is done;
+// it's a variable so that tests don't have to
+var sleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// delay returns how long to wait before retrying a request for the given
+// (zero-based) attempt, and false if the server asked for too long a wait.
+func (p RetryPolicy) delay(attempt int, err error) (time.Duration, bool) {
+	if e, ok := err.(HTTPError); ok && e.RetryAfter > 0 {
+		return e.RetryAfter, e.RetryAfter <= p.MaxRetryAfter
+	}
+
+	delay := p.BaseDelay << uint(attempt)
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+
+	// use a random delay between half and all of the backoff delay so that
+	// clients don't all retry at once
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1)), true
+}
+
+// OnUnauthorized, if set, is called with a Session's API key when Redmine
+// rejects a request made with it. Since requests may be made concurrently, it
+// may be called from several goroutines at once.
+var OnUnauthorized func(apiKey string)
+
 // structures ///////////////////////////
 
-// Session represents an active connection to a Redmine server.
+// Session represents an active connection to a Redmine server. Each method
+// that talks to the server has a Context variant that stops waiting for the
+// server when the context is cancelled or its deadline passes; the plain
+// methods never give up.
 type Session struct {
-	username string
-	password string
-	url      string
-	apiKey   string
+	username        string
+	password        string
+	url             string
+	apiKey          string
+	gatewayUsername string
+	gatewayPassword string
+	headers         map[string]string
 }
 
 // User represents a Redmine user.
 type User struct {
-	ID          int    `json:"id"`
-	APIKey      string `json:"api_key"`
-	Login       string `json:"login"`
-	Mail        string `json:"mail"`
-	LastLoginOn string `json:"last_login_on"`
+	ID          int          `json:"id"`
+	APIKey      string       `json:"api_key"`
+	Login       string       `json:"login"`
+	Mail        string       `json:"mail"`
+	LastLoginOn string       `json:"last_login_on"`
+	Groups      []IDentifier `json:"groups,omitempty"`
 }
 
 // Project represents a Redmine project.
 type Project struct {
-	CreatedOn   string `json:"created_on"`
-	Description string `json:"description"`
-	ID          int    `json:"id"`
-	IsPublic    bool   `json:"is_public"`
-	Name        string `json:"name"`
-	UpdatedOn   string `json:"updated_on"`
+	CreatedOn   string       `json:"created_on"`
+	Description string       `json:"description"`
+	Homepage    string       `json:"homepage"`
+	ID          int          `json:"id"`
+	Identifier  string       `json:"identifier"`
+	IsPublic    bool         `json:"is_public"`
+	Name        string       `json:"name"`
+	Parent      IDentifier   `json:"parent,omitempty"`
+	Status      int          `json:"status"`
+	Trackers    []IDentifier `json:"trackers,omitempty"`
+	UpdatedOn   string       `json:"updated_on"`
 }
 
+// Membership represents a user's or group's roles in a project.
+type Membership struct {
+	ID      int          `json:"id"`
+	Project IDentifier   `json:"project"`
+	User    IDentifier   `json:"user,omitempty"`
+	Group   IDentifier   `json:"group,omitempty"`
+	Roles   []IDentifier `json:"roles"`
+}
+
+// Project statuses
+const (
+	ProjectStatusActive   = 1
+	ProjectStatusClosed   = 5
+	ProjectStatusArchived = 9
+)
+
 // Issue represents a single issue in Redmine.
 type Issue struct {
-	AssignedTo     IDentifier   `json:"assigned_to,omitempty"`
-	Author         IDentifier   `json:"author,omitempty"`
-	Category       IDentifier   `json:"category,omitempty"`
-	CreatedOn      string       `json:"created_on,omitempty"`
-	CustomFields   []ValueField `json:"custom_fields,omitempty"`
-	Description    string       `json:"description,omitempty"`
-	DoneRatio      int          `json:"done_ratio,omitempty"`
-	DueDate        string       `json:"due_date,omitempty"`
-	EstimatedHours float64      `json:"estimated_hours,omitempty"`
-	ID             int          `json:"id,omitempty"`
-	Priority       IDentifier   `json:"priority,omitempty"`
-	Project        IDentifier   `json:"project,omitempty"`
-	StartDate      string       `json:"start_date,omitempty"`
-	Status         IssueStatus  `json:"status,omitempty"`
-	Subject        string       `json:"subject,omitempty"`
-	Tracker        IDentifier   `json:"tracker,omitempty"`
-	UpdatedOn      string       `json:"updated_on,omitempty"`
+	AssignedTo      IDentifier   `json:"assigned_to,omitempty"`
+	Attachments     []Attachment `json:"attachments,omitempty"`
+	Author          IDentifier   `json:"author,omitempty"`
+	Category        IDentifier   `json:"category,omitempty"`
+	Children        []IssueChild `json:"children,omitempty"`
+	CreatedOn       string       `json:"created_on,omitempty"`
+	CustomFields    []ValueField `json:"custom_fields,omitempty"`
+	Description     string       `json:"description,omitempty"`
+	DoneRatio       int          `json:"done_ratio,omitempty"`
+	DueDate         string       `json:"due_date,omitempty"`
+	EstimatedHours  float64      `json:"estimated_hours,omitempty"`
+	FixedVersion    IDentifier   `json:"fixed_version,omitempty"`
+	ID              int          `json:"id,omitempty"`
+	Parent          IDentifier   `json:"parent,omitempty"`
+	Priority        IDentifier   `json:"priority,omitempty"`
+	Project         IDentifier   `json:"project,omitempty"`
+	Relations       []Relation   `json:"relations,omitempty"`
+	SpentHours      float64      `json:"spent_hours,omitempty"`
+	StartDate       string       `json:"start_date,omitempty"`
+	Status          IssueStatus  `json:"status,omitempty"`
+	Subject         string       `json:"subject,omitempty"`
+	TotalSpentHours float64      `json:"total_spent_hours,omitempty"`
+	Tracker         IDentifier   `json:"tracker,omitempty"`
+	UpdatedOn       string       `json:"updated_on,omitempty"`
+	Watchers        []IDentifier `json:"watchers,omitempty"`
+}
+
+// IssueChild is a summary of a subtask, as included in a parent issue.
+type IssueChild struct {
+	ID       int          `json:"id"`
+	Tracker  IDentifier   `json:"tracker"`
+	Subject  string       `json:"subject"`
+	Children []IssueChild `json:"children,omitempty"`
 }
 
 // UpdateIssue is used to pass updates to Redmine.
 type UpdateIssue struct {
-	AssignedTo     int     `json:"assigned_to_id,omitempty"`
-	Author         int     `json:"author_id,omitempty"`
-	Category       int     `json:"category_id,omitempty"`
-	CreatedOn      string  `json:"created_on,omitempty"`
-	Description    string  `json:"description,omitempty"`
-	DoneRatio      int     `json:"done_ratio,omitempty"`
-	DueDate        string  `json:"due_date,omitempty"`
-	EstimatedHours float64 `json:"estimated_hours,omitempty"`
-	Priority       int     `json:"priority_id,omitempty"`
-	Project        int     `json:"project_id,omitempty"`
-	StartDate      string  `json:"start_date,omitempty"`
-	Status         int     `json:"status_id,omitempty"`
-	Subject        string  `json:"subject,omitempty"`
-	Tracker        int     `json:"tracker_id,omitempty"`
-	UpdatedOn      string  `json:"updated_on,omitempty"`
+	AssignedTo     int      `json:"assigned_to_id,omitempty"`
+	Author         int      `json:"author_id,omitempty"`
+	Category       int      `json:"category_id,omitempty"`
+	CreatedOn      string   `json:"created_on,omitempty"`
+	Description    string   `json:"description,omitempty"`
+	DoneRatio      int      `json:"done_ratio,omitempty"`
+	DueDate        string   `json:"due_date,omitempty"`
+	EstimatedHours float64  `json:"estimated_hours,omitempty"`
+	ParentIssue    int      `json:"parent_issue_id,omitempty"`
+	Priority       int      `json:"priority_id,omitempty"`
+	Project        int      `json:"project_id,omitempty"`
+	StartDate      string   `json:"start_date,omitempty"`
+	Status         int      `json:"status_id,omitempty"`
+	Subject        string   `json:"subject,omitempty"`
+	Tracker        int      `json:"tracker_id,omitempty"`
+	UpdatedOn      string   `json:"updated_on,omitempty"`
+	Uploads        []Upload `json:"uploads,omitempty"`
+	WatcherUserIDs []int    `json:"watcher_user_ids,omitempty"`
+}
+
+// Relation represents a relationship between two issues. The relation is
+// described from the point of view of IssueID, e.g. "IssueID blocks IssueToID".
+type Relation struct {
+	ID           int    `json:"id,omitempty"`
+	IssueID      int    `json:"issue_id,omitempty"`
+	IssueToID    int    `json:"issue_to_id"`
+	RelationType string `json:"relation_type"`
+	Delay        *int   `json:"delay,omitempty"`
+}
+
+// Relation types that can be used when creating a relation. Redmine reports
+// the inverse types (blocked, follows, duplicated, copied_from) as the
+// corresponding type with the issues swapped.
+const (
+	RelationRelates    = "relates"
+	RelationBlocks     = "blocks"
+	RelationPrecedes   = "precedes"
+	RelationDuplicates = "duplicates"
+	RelationCopiedTo   = "copied_to"
+)
+
+// Attachment represents a file attached to an issue.
+type Attachment struct {
+	ID          int        `json:"id"`
+	Filename    string     `json:"filename"`
+	Filesize    int64      `json:"filesize"`
+	ContentType string     `json:"content_type"`
+	Description string     `json:"description"`
+	ContentURL  string     `json:"content_url"`
+	Author      IDentifier `json:"author"`
+	CreatedOn   string     `json:"created_on"`
+}
+
+// Upload identifies a file that has been uploaded to Redmine but not yet
+// attached to anything.
+type Upload struct {
+	Token       string `json:"token"`
+	Filename    string `json:"filename,omitempty"`
+	Description string `json:"description,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
 }
 
 // IssueStatus represents one of the issue statuses configured in Redmine.
@@ -98,6 +254,35 @@ type IssueStatus struct {
 	IsClosed  bool   `json:"is_closed,omitempty"`
 }
 
+// Version represents a project version (a release target) in Redmine.
+type Version struct {
+	ID          int        `json:"id"`
+	Project     IDentifier `json:"project"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Status      string     `json:"status"`
+	DueDate     string     `json:"due_date"`
+	Sharing     string     `json:"sharing"`
+	CreatedOn   string     `json:"created_on"`
+	UpdatedOn   string     `json:"updated_on"`
+}
+
+// WikiPage represents a page in a project's wiki. Text is only included when
+// a single page is requested.
+type WikiPage struct {
+	Title     string     `json:"title"`
+	Text      string     `json:"text,omitempty"`
+	Version   int        `json:"version"`
+	Author    IDentifier `json:"author,omitempty"`
+	Comments  string     `json:"comments,omitempty"`
+	CreatedOn string     `json:"created_on"`
+	UpdatedOn string     `json:"updated_on"`
+	Parent    struct {
+		Title string `json:"title,omitempty"`
+	} `json:"parent,omitempty"`
+	Project IDentifier `json:"project,omitempty"`
+}
+
 // TimeEntry represents a single time entry.
 type TimeEntry struct {
 	ID        int        `json:"id"`
@@ -108,11 +293,22 @@ type TimeEntry struct {
 	User      IDentifier `json:"user"`
 	Project   IDentifier `json:"project"`
 	Activity  IDentifier `json:"activity"`
+	Comments  string     `json:"comments"`
 	Issue     struct {
 		ID int `json:"id"`
 	} `json:"issue"`
 }
 
+// UpdateTimeEntry is used to pass new time entries to Redmine.
+type UpdateTimeEntry struct {
+	Issue    int     `json:"issue_id,omitempty"`
+	Project  int     `json:"project_id,omitempty"`
+	SpentOn  string  `json:"spent_on,omitempty"`
+	Hours    float64 `json:"hours"`
+	Activity int     `json:"activity_id,omitempty"`
+	Comments string  `json:"comments,omitempty"`
+}
+
 // An IDentifier is a name/id pair.
 type IDentifier struct {
 	Name string `json:"name,omitempty"`
@@ -125,36 +321,193 @@ type ValueField struct {
 	Value string `json:"value,omitempty"`
 }
 
+// TLSOptions control how Sessions verify Redmine servers and identify
+// themselves to them.
+type TLSOptions struct {
+	// AllowSelfSigned turns off certificate verification entirely.
+	AllowSelfSigned bool
+
+	// CAFile is a PEM file of CA certificates that are trusted in addition
+	// to the system's.
+	CAFile string
+
+	// PinnedKeys are base64 SHA-256 hashes of subject public key info. If
+	// any are given, the server's certificate chain must contain one of the
+	// keys, even when AllowSelfSigned is set.
+	PinnedKeys []string
+
+	// ClientCert and ClientKey are PEM files holding a client certificate
+	// and its private key, for servers that require mutual TLS.
+	ClientCert string
+	ClientKey  string
+}
+
+// ClientOptions control the connections used by all Sessions.
+type ClientOptions struct {
+	TLSOptions
+
+	// Proxy is the URL of the proxy requests are sent through, "none" to
+	// connect directly, or empty to use the proxy given by the HTTPS_PROXY,
+	// HTTP_PROXY and NO_PROXY environment variables.
+	Proxy string
+}
+
 // AllowSelfSignedCert tells a session whether or not to allow SSL connections to
 // servers with self-signed certificates
 func AllowSelfSignedCert(allow bool) {
-	if allow {
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	ConfigureTLS(TLSOptions{AllowSelfSigned: allow})
+}
+
+// ConfigureTLS sets up the HTTPS connections used by all Sessions, using the
+// proxy settings from the environment.
+func ConfigureTLS(opts TLSOptions) error {
+	return ConfigureClient(ClientOptions{TLSOptions: opts})
+}
+
+// ConfigureClient sets up the connections used by all Sessions. If the
+// options can't be applied, requests fail with the returned error rather than
+// being made with weaker security or through a different route than was
+// asked for.
+func ConfigureClient(opts ClientOptions) error {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+
+	config, err := newTLSConfig(opts.TLSOptions)
+	if err == nil {
+		tr.TLSClientConfig = config
+		tr.Proxy, err = newProxyFunc(opts.Proxy)
+	}
+	if err != nil {
+		client = &http.Client{Transport: failingTransport{err}}
+		return err
+	}
+
+	client = &http.Client{Transport: tr}
+	return nil
+}
+
+func newProxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	switch strings.ToLower(proxy) {
+	case "", "env":
+		return http.ProxyFromEnvironment, nil
+	case "none":
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy URL %s", proxy)
+	}
+	if password, ok := proxyURL.User.Password(); ok {
+		addSecret(password)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+func newTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: opts.AllowSelfSigned}
+
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA file: %v", err)
 		}
-		client = &http.Client{Transport: tr}
-	} else {
-		client = &http.Client{}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file %s", opts.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.ClientCert != "" || opts.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
 	}
+
+	if len(opts.PinnedKeys) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range opts.PinnedKeys {
+			if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("Invalid pinned key %s", pin)
+			}
+			pins[pin] = true
+		}
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return checkPinnedKeys(state, pins)
+		}
+	}
+
+	return config, nil
 }
 
-// NewSession creates a new session for a Redmine server.
-func NewSession(redmineURL, username, password string) (Session, error) {
-	session := Session{
-		url:      redmineURL,
-		username: username,
-		password: password,
+// checkPinnedKeys makes sure that a connection's certificate chain includes
+// one of the pinned keys. Only verified chains are checked unless
+// verification is turned off.
+func checkPinnedKeys(state tls.ConnectionState, pins map[string]bool) error {
+	certs := state.PeerCertificates
+	if len(state.VerifiedChains) > 0 {
+		certs = nil
+		for _, chain := range state.VerifiedChains {
+			certs = append(certs, chain...)
+		}
 	}
 
-	user, err := session.GetUser()
-	if err != nil {
-		return session, err
+	for _, cert := range certs {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[base64.StdEncoding.EncodeToString(hash[:])] {
+			return nil
+		}
 	}
 
-	dlog.Printf("got user: %v", user)
-	session.apiKey = user.APIKey
+	return errKeyNotPinned
+}
 
-	return session, nil
+var errGatewayNeedsKey = fmt.Errorf("Redmine must be logged in to with an API key when using a gateway")
+
+var errGatewayRejected = fmt.Errorf("The gateway rejected its username or password")
+
+var errKeyNotPinned = fmt.Errorf("The server's certificate doesn't match any pinned key")
+
+// failingTransport fails every request, for when the client can't be set up
+// as configured.
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, clientConfigError{t.err}
+}
+
+// clientConfigError is returned for requests that couldn't be made because of
+// a problem with the client's settings.
+type clientConfigError struct {
+	err error
+}
+
+func (e clientConfigError) Error() string {
+	return e.err.Error()
+}
+
+func (e clientConfigError) Unwrap() error {
+	return e.err
+}
+
+// NewSession creates a new session for a Redmine server.
+func NewSession(redmineURL, username, password string) (Session, error) {
+	return NewSessionContext(context.Background(), redmineURL, username, password)
+}
+
+// NewSessionContext is like NewSession but uses ctx for its requests.
+func NewSessionContext(ctx context.Context, redmineURL, username, password string) (Session, error) {
+	session := Session{url: redmineURL}
+	err := session.LogInContext(ctx, username, password)
+	return session, err
 }
 
 // OpenSession opens an existing session for a Redmine server.
@@ -163,9 +516,49 @@ func OpenSession(redmineURL, apiKey string) Session {
 		url:    redmineURL,
 		apiKey: apiKey,
 	}
+	addSecret(apiKey)
 	return session
 }
 
+// LogIn uses a username and password to get the user's API key, which the
+// Session uses from then on.
+func (session *Session) LogIn(username, password string) error {
+	return session.LogInContext(context.Background(), username, password)
+}
+
+// LogInContext is like LogIn but uses ctx for its requests.
+func (session *Session) LogInContext(ctx context.Context, username, password string) error {
+	session.username = username
+	session.password = password
+	addSecret(password)
+
+	user, err := session.GetUserContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	dlog.Printf("got user: %s", user.Login)
+	session.apiKey = user.APIKey
+	addSecret(session.apiKey)
+
+	return nil
+}
+
+// SetGateway makes a Session authenticate with a gateway or reverse proxy in
+// front of Redmine using basic auth. Since basic auth can only carry one set
+// of credentials, Redmine itself must then be authenticated with an API key.
+func (session *Session) SetGateway(username, password string) {
+	session.gatewayUsername = username
+	session.gatewayPassword = password
+	addSecret(password)
+}
+
+// SetHeaders sets extra headers to send with every request, such as ones a
+// gateway needs.
+func (session *Session) SetHeaders(headers map[string]string) {
+	session.headers = headers
+}
+
 // URL returns the Redmine server URL for a Session.
 func (session *Session) URL() string {
 	return session.url
@@ -183,8 +576,14 @@ func (session *Session) IssueURL(issue Issue) string {
 
 // GetUser returns account data for the user a Session was created for.
 func (session *Session) GetUser() (user User, err error) {
+	return session.GetUserContext(context.Background())
+}
+
+// GetUserContext is like GetUser but uses ctx for its requests.
+func (session *Session) GetUserContext(ctx context.Context) (user User, err error) {
 	var data []byte
-	if data, err = session.get("/users/current.json", nil); err != nil {
+	params := map[string]string{"include": "groups"}
+	if data, err = session.get(ctx, "/users/current.json", params); err != nil {
 		return
 	}
 
@@ -202,48 +601,60 @@ func (session *Session) GetUser() (user User, err error) {
 
 // GetIssues returns an array of all open issues assigned to the Session user.
 func (session *Session) GetIssues() ([]Issue, error) {
+	return session.GetIssuesContext(context.Background())
+}
+
+// GetIssuesContext is like GetIssues but uses ctx for its requests.
+func (session *Session) GetIssuesContext(ctx context.Context) ([]Issue, error) {
 	params := map[string]string{
 		// "assigned_to_id": "me",
 		"watcher_id": "me",
-		"limit":      "100"}
-	var issues []Issue
-	offset := 0
-
-	for {
-		data, err := session.get("/issues.json", params)
-		if err != nil {
-			return nil, err
-		}
-
-		var list struct {
-			Issues     []Issue `json:"issues"`
-			Limit      int     `json:"limit"`
-			Offset     int     `json:"offset"`
-			TotalCount int     `json:"total_count"`
-		}
+		"include":    "attachments,relations"}
+	return getPaged[Issue](ctx, session, "/issues.json", params, "issues")
+}
 
-		dec := json.NewDecoder(bytes.NewReader(data))
-		err = dec.Decode(&list)
-		if err != nil {
-			return nil, err
-		}
+// GetIssuesUpdatedSince returns the issues being watched by the current user
+// that have been updated since a given time, including closed issues.
+func (session *Session) GetIssuesUpdatedSince(since time.Time) ([]Issue, error) {
+	return session.GetIssuesUpdatedSinceContext(context.Background(), since)
+}
 
-		issues = append(issues, list.Issues...)
-		if len(issues) == list.TotalCount {
-			break
-		}
+// GetIssuesUpdatedSinceContext is like GetIssuesUpdatedSince but uses ctx for
+// its requests.
+func (session *Session) GetIssuesUpdatedSinceContext(ctx context.Context, since time.Time) ([]Issue, error) {
+	params := map[string]string{
+		"watcher_id": "me",
+		"status_id":  "*",
+		"updated_on": ">=" + since.UTC().Format("2006-01-02T15:04:05Z"),
+		"include":    "attachments,relations"}
+	return getPaged[Issue](ctx, session, "/issues.json", params, "issues")
+}
 
-		offset += len(issues)
-		params["offset"] = strconv.Itoa(offset)
-	}
+// GetWatchedClosedIssues returns the closed issues being watched by the
+// current user.
+func (session *Session) GetWatchedClosedIssues() ([]Issue, error) {
+	return session.GetWatchedClosedIssuesContext(context.Background())
+}
 
-	return issues, nil
+// GetWatchedClosedIssuesContext is like GetWatchedClosedIssues but uses ctx
+// for its requests.
+func (session *Session) GetWatchedClosedIssuesContext(ctx context.Context) ([]Issue, error) {
+	params := map[string]string{
+		"watcher_id": "me",
+		"status_id":  "closed"}
+	return getPaged[Issue](ctx, session, "/issues.json", params, "issues")
 }
 
 // GetIssue returns a specific issue.
 func (session *Session) GetIssue(id int) (issue Issue, err error) {
+	return session.GetIssueContext(context.Background(), id)
+}
+
+// GetIssueContext is like GetIssue but uses ctx for its requests.
+func (session *Session) GetIssueContext(ctx context.Context, id int) (issue Issue, err error) {
 	var data []byte
-	if data, err = session.get("/issues/"+strconv.Itoa(id)+".json", nil); err != nil {
+	params := map[string]string{"include": "attachments,children,relations,watchers"}
+	if data, err = session.get(ctx, "/issues/"+strconv.Itoa(id)+".json", params); err != nil {
 		return
 	}
 
@@ -258,103 +669,418 @@ func (session *Session) GetIssue(id int) (issue Issue, err error) {
 	return
 }
 
+// UpdateIssue updates an existing issue.
 func (session *Session) UpdateIssue(id int, issue UpdateIssue) (err error) {
+	return session.UpdateIssueContext(context.Background(), id, issue)
+}
+
+// UpdateIssueContext is like UpdateIssue but uses ctx for its requests.
+func (session *Session) UpdateIssueContext(ctx context.Context, id int, issue UpdateIssue) (err error) {
 	dlog.Printf("Updating issue %v", issue)
 	data := map[string]interface{}{
 		"issue": issue,
 	}
 	var resp []byte
-	resp, err = session.put("/issues/"+strconv.Itoa(id)+".json", data)
-	dlog.Printf("got response: %s", string(resp))
+	resp, err = session.put(ctx, "/issues/"+strconv.Itoa(id)+".json", data)
+	tlog.Printf("got response: %s", string(resp))
+	return err
+}
+
+// CreateIssue creates a new issue. At least the project and subject must be
+// set.
+func (session *Session) CreateIssue(issue UpdateIssue) (created Issue, err error) {
+	return session.CreateIssueContext(context.Background(), issue)
+}
+
+// CreateIssueContext is like CreateIssue but uses ctx for its requests.
+func (session *Session) CreateIssueContext(ctx context.Context, issue UpdateIssue) (created Issue, err error) {
+	dlog.Printf("Creating issue %v", issue)
+	data := map[string]interface{}{
+		"issue": issue,
+	}
+
+	var resp []byte
+	if resp, err = session.post(ctx, "/issues.json", data); err != nil {
+		return
+	}
+
+	var i struct {
+		Issue Issue `json:"issue"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(resp))
+	if err = dec.Decode(&i); err != nil {
+		return
+	}
+
+	created = i.Issue
+	return
+}
+
+// GetIssuesByID returns the issues with the given IDs, whether open or closed.
+// Issues that don't exist or aren't visible to the Session user are silently
+// left out. Issues are requested in batches; if a batch fails, the issues from
+// the batches before it are returned along with the error.
+func (session *Session) GetIssuesByID(ids []int) ([]Issue, error) {
+	return session.GetIssuesByIDContext(context.Background(), ids)
+}
+
+// GetIssuesByIDContext is like GetIssuesByID but uses ctx for its requests.
+func (session *Session) GetIssuesByIDContext(ctx context.Context, ids []int) ([]Issue, error) {
+	var issues []Issue
+
+	for start := 0; start < len(ids); start += pageSize {
+		end := start + pageSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		var strIDs []string
+		for _, id := range ids[start:end] {
+			strIDs = append(strIDs, strconv.Itoa(id))
+		}
+
+		params := map[string]string{
+			"issue_id":  strings.Join(strIDs, ","),
+			"status_id": "*"}
+
+		batch, err := getPaged[Issue](ctx, session, "/issues.json", params, "issues")
+		if err != nil {
+			return issues, err
+		}
+
+		issues = append(issues, batch...)
+	}
+
+	return issues, nil
+}
+
+// CreateRelation relates one issue to another. The relation's IssueToID and
+// RelationType must be set.
+func (session *Session) CreateRelation(issueID int, relation Relation) (created Relation, err error) {
+	return session.CreateRelationContext(context.Background(), issueID, relation)
+}
+
+// CreateRelationContext is like CreateRelation but uses ctx for its requests.
+func (session *Session) CreateRelationContext(ctx context.Context, issueID int, relation Relation) (created Relation, err error) {
+	relation.ID = 0
+	relation.IssueID = 0
+	data := map[string]interface{}{
+		"relation": relation,
+	}
+
+	var resp []byte
+	if resp, err = session.post(ctx, "/issues/"+strconv.Itoa(issueID)+"/relations.json", data); err != nil {
+		return
+	}
+
+	var r struct {
+		Relation Relation `json:"relation"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(resp))
+	if err = dec.Decode(&r); err != nil {
+		return
+	}
+
+	created = r.Relation
+	return
+}
+
+// DeleteRelation removes a relation between two issues.
+func (session *Session) DeleteRelation(relationID int) error {
+	return session.DeleteRelationContext(context.Background(), relationID)
+}
+
+// DeleteRelationContext is like DeleteRelation but uses ctx for its requests.
+func (session *Session) DeleteRelationContext(ctx context.Context, relationID int) error {
+	_, err := session.delete(ctx, "/relations/"+strconv.Itoa(relationID)+".json")
 	return err
 }
 
+// AddWatcher adds a user to the watchers of an issue.
+func (session *Session) AddWatcher(issueID, userID int) error {
+	return session.AddWatcherContext(context.Background(), issueID, userID)
+}
+
+// AddWatcherContext is like AddWatcher but uses ctx for its requests.
+func (session *Session) AddWatcherContext(ctx context.Context, issueID, userID int) error {
+	data := map[string]interface{}{
+		"user_id": userID,
+	}
+	// adding a watcher twice has no effect, so this is safe to retry
+	_, err := session.send(ctx, "POST", "/issues/"+strconv.Itoa(issueID)+"/watchers.json", data, true)
+	return err
+}
+
+// RemoveWatcher removes a user from the watchers of an issue.
+func (session *Session) RemoveWatcher(issueID, userID int) error {
+	return session.RemoveWatcherContext(context.Background(), issueID, userID)
+}
+
+// RemoveWatcherContext is like RemoveWatcher but uses ctx for its requests.
+func (session *Session) RemoveWatcherContext(ctx context.Context, issueID, userID int) error {
+	_, err := session.delete(ctx, "/issues/"+strconv.Itoa(issueID)+"/watchers/"+strconv.Itoa(userID)+".json")
+	return err
+}
+
+// UploadFile uploads a file to Redmine. The returned Upload can be attached to
+// an issue by including it in an UpdateIssue.
+func (session *Session) UploadFile(file string) (upload Upload, err error) {
+	return session.UploadFileContext(context.Background(), file)
+}
+
+// UploadFileContext is like UploadFile but uses ctx for its requests.
+func (session *Session) UploadFileContext(ctx context.Context, file string) (upload Upload, err error) {
+	var content []byte
+	if content, err = ioutil.ReadFile(file); err != nil {
+		return
+	}
+
+	name := filepath.Base(file)
+	path := "/uploads.json?" + toQueryString(map[string]string{"filename": name})
+	dlog.Printf("POSTing %d bytes to URL %s", len(content), session.url+path)
+
+	var data []byte
+	if data, err = session.request(ctx, "POST", session.url+path, "application/octet-stream", content, false); err != nil {
+		return
+	}
+
+	var u struct {
+		Upload Upload `json:"upload"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err = dec.Decode(&u); err != nil {
+		return
+	}
+
+	upload = u.Upload
+	upload.Filename = name
+	upload.ContentType = mime.TypeByExtension(filepath.Ext(name))
+	return
+}
+
+// GetAttachment returns the content of an attachment.
+func (session *Session) GetAttachment(attachment Attachment) ([]byte, error) {
+	return session.GetAttachmentContext(context.Background(), attachment)
+}
+
+// GetAttachmentContext is like GetAttachment but uses ctx for its requests.
+func (session *Session) GetAttachmentContext(ctx context.Context, attachment Attachment) ([]byte, error) {
+	// the download URL is built from the session's URL rather than taken from
+	// the attachment, so the API key is only ever sent to the server
+	requestURL := fmt.Sprintf("%s/attachments/download/%d", session.url, attachment.ID)
+	dlog.Printf("GETing from URL: %s", requestURL)
+	return session.request(ctx, "GET", requestURL, "", nil, true)
+}
+
 // GetTimeEntries returns all time entries from a given number of days in the
 // past until now.
 func (session *Session) GetTimeEntries(daysBack int) ([]TimeEntry, error) {
+	return session.GetTimeEntriesContext(context.Background(), daysBack)
+}
+
+// GetTimeEntriesContext is like GetTimeEntries but uses ctx for its requests.
+func (session *Session) GetTimeEntriesContext(ctx context.Context, daysBack int) ([]TimeEntry, error) {
 	since := time.Now().AddDate(0, 0, -daysBack).Format("2006-01-02")
 	until := time.Now().Format("2006-01-02")
 	params := map[string]string{
 		"user_id":  "me",
-		"spent_on": "><" + since + "|" + until,
-		"limit":    "100"}
+		"spent_on": "><" + since + "|" + until}
+	return getPaged[TimeEntry](ctx, session, "/time_entries.json", params, "time_entries")
+}
 
-	var entries []TimeEntry
-	offset := 0
+// GetProjects returns an array of all the projects the Session user belongs to.
+func (session *Session) GetProjects() ([]Project, error) {
+	return session.GetProjectsContext(context.Background())
+}
 
-	for {
-		data, err := session.get("/time_entries.json", params)
-		if err != nil {
-			return nil, err
-		}
+// GetProjectsContext is like GetProjects but uses ctx for its requests.
+func (session *Session) GetProjectsContext(ctx context.Context) ([]Project, error) {
+	return getPaged[Project](ctx, session, "/projects.json", nil, "projects")
+}
 
-		var list struct {
-			TimeEntries []TimeEntry `json:"time_entries"`
-			Limit       int         `json:"limit"`
-			Offset      int         `json:"offset"`
-			TotalCount  int         `json:"total_count"`
-		}
+// GetProject returns a specific project, including its enabled trackers.
+func (session *Session) GetProject(id int) (project Project, err error) {
+	return session.GetProjectContext(context.Background(), id)
+}
 
-		dec := json.NewDecoder(bytes.NewReader(data))
-		err = dec.Decode(&list)
-		if err != nil {
-			return nil, err
-		}
+// GetProjectContext is like GetProject but uses ctx for its requests.
+func (session *Session) GetProjectContext(ctx context.Context, id int) (project Project, err error) {
+	var data []byte
+	params := map[string]string{"include": "trackers"}
+	if data, err = session.get(ctx, "/projects/"+strconv.Itoa(id)+".json", params); err != nil {
+		return
+	}
 
-		entries = append(entries, list.TimeEntries...)
-		if len(entries) == list.TotalCount {
-			break
-		}
+	var p struct {
+		Project Project `json:"project"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err = dec.Decode(&p); err != nil {
+		return
+	}
 
-		offset += len(entries)
-		params["offset"] = strconv.Itoa(offset)
+	project = p.Project
+	return
+}
+
+// GetMemberships returns the memberships of a project.
+func (session *Session) GetMemberships(projectID int) ([]Membership, error) {
+	return session.GetMembershipsContext(context.Background(), projectID)
+}
+
+// GetMembershipsContext is like GetMemberships but uses ctx for its requests.
+func (session *Session) GetMembershipsContext(ctx context.Context, projectID int) ([]Membership, error) {
+	path := "/projects/" + strconv.Itoa(projectID) + "/memberships.json"
+	return getPaged[Membership](ctx, session, path, nil, "memberships")
+}
+
+// GetProjectIssues returns all the open issues in a project.
+func (session *Session) GetProjectIssues(projectID int) ([]Issue, error) {
+	return session.GetProjectIssuesContext(context.Background(), projectID)
+}
+
+// GetProjectIssuesContext is like GetProjectIssues but uses ctx for its
+// requests.
+func (session *Session) GetProjectIssuesContext(ctx context.Context, projectID int) ([]Issue, error) {
+	params := map[string]string{
+		"project_id": strconv.Itoa(projectID),
+		"status_id":  "open"}
+	return getPaged[Issue](ctx, session, "/issues.json", params, "issues")
+}
+
+// CreateTimeEntry logs time against an issue or project.
+func (session *Session) CreateTimeEntry(entry UpdateTimeEntry) (created TimeEntry, err error) {
+	return session.CreateTimeEntryContext(context.Background(), entry)
+}
+
+// CreateTimeEntryContext is like CreateTimeEntry but uses ctx for its requests.
+func (session *Session) CreateTimeEntryContext(ctx context.Context, entry UpdateTimeEntry) (created TimeEntry, err error) {
+	data := map[string]interface{}{
+		"time_entry": entry,
 	}
 
-	return entries, nil
+	var resp []byte
+	if resp, err = session.post(ctx, "/time_entries.json", data); err != nil {
+		return
+	}
+
+	var t struct {
+		TimeEntry TimeEntry `json:"time_entry"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(resp))
+	if err = dec.Decode(&t); err != nil {
+		return
+	}
+
+	created = t.TimeEntry
+	return
 }
 
-// GetProjects returns an array of all the projects the Session user belongs to.
-func (session *Session) GetProjects() ([]Project, error) {
+// GetVersions returns the versions defined for (or shared with) a project.
+func (session *Session) GetVersions(projectID int) ([]Version, error) {
+	return session.GetVersionsContext(context.Background(), projectID)
+}
+
+// GetVersionsContext is like GetVersions but uses ctx for its requests.
+func (session *Session) GetVersionsContext(ctx context.Context, projectID int) ([]Version, error) {
+	data, err := session.get(ctx, "/projects/"+strconv.Itoa(projectID)+"/versions.json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		Versions []Version `json:"versions"`
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	err = dec.Decode(&list)
+	if err != nil {
+		return nil, err
+	}
+
+	return list.Versions, nil
+}
+
+// GetVersionIssues returns all the closed issues targeted at a given version.
+func (session *Session) GetVersionIssues(versionID int) ([]Issue, error) {
+	return session.GetVersionIssuesContext(context.Background(), versionID)
+}
+
+// GetVersionIssuesContext is like GetVersionIssues but uses ctx for its
+// requests.
+func (session *Session) GetVersionIssuesContext(ctx context.Context, versionID int) ([]Issue, error) {
 	params := map[string]string{
-		"limit": "100"}
+		"fixed_version_id": strconv.Itoa(versionID),
+		"status_id":        "closed",
+		"sort":             "id"}
+	return getPaged[Issue](ctx, session, "/issues.json", params, "issues")
+}
 
-	var projects []Project
-	offset := 0
+// GetWikiPages returns an index of the wiki pages in a project. The returned
+// pages don't include any text.
+func (session *Session) GetWikiPages(projectID int) ([]WikiPage, error) {
+	return session.GetWikiPagesContext(context.Background(), projectID)
+}
 
-	for {
-		data, err := session.get("/projects.json", params)
-		if err != nil {
-			return nil, err
-		}
+// GetWikiPagesContext is like GetWikiPages but uses ctx for its requests.
+func (session *Session) GetWikiPagesContext(ctx context.Context, projectID int) ([]WikiPage, error) {
+	data, err := session.get(ctx, "/projects/"+strconv.Itoa(projectID)+"/wiki/index.json", nil)
+	if err != nil {
+		return nil, err
+	}
 
-		var list struct {
-			Projects   []Project `json:"projects"`
-			TotalCount int       `json:"total_count"`
-			Offset     int       `json:"offset"`
-			Limit      int       `json:"limit"`
-		}
+	var list struct {
+		WikiPages []WikiPage `json:"wiki_pages"`
+	}
 
-		dec := json.NewDecoder(bytes.NewReader(data))
-		err = dec.Decode(&list)
-		if err != nil {
-			return nil, err
-		}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	err = dec.Decode(&list)
+	if err != nil {
+		return nil, err
+	}
 
-		projects = append(projects, list.Projects...)
-		if len(projects) == list.TotalCount {
-			break
-		}
+	for i := range list.WikiPages {
+		list.WikiPages[i].Project.ID = projectID
+	}
+
+	return list.WikiPages, nil
+}
+
+// GetWikiPage returns a specific wiki page, including its text.
+func (session *Session) GetWikiPage(projectID int, title string) (page WikiPage, err error) {
+	return session.GetWikiPageContext(context.Background(), projectID, title)
+}
 
-		offset = len(projects)
-		params["offset"] = strconv.Itoa(offset)
+// GetWikiPageContext is like GetWikiPage but uses ctx for its requests.
+func (session *Session) GetWikiPageContext(ctx context.Context, projectID int, title string) (page WikiPage, err error) {
+	var data []byte
+	path := "/projects/" + strconv.Itoa(projectID) + "/wiki/" + url.PathEscape(title) + ".json"
+	if data, err = session.get(ctx, path, nil); err != nil {
+		return
 	}
 
-	return projects, nil
+	var p struct {
+		WikiPage WikiPage `json:"wiki_page"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err = dec.Decode(&p); err != nil {
+		return
+	}
+
+	page = p.WikiPage
+	page.Project.ID = projectID
+	return
 }
 
 // GetIssueStatuses returns an array of all the available issue statuses.
 func (session *Session) GetIssueStatuses() ([]IssueStatus, error) {
-	data, err := session.get("/issue_statuses.json", nil)
+	return session.GetIssueStatusesContext(context.Background())
+}
+
+// GetIssueStatusesContext is like GetIssueStatuses but uses ctx for its
+// requests.
+func (session *Session) GetIssueStatusesContext(ctx context.Context) ([]IssueStatus, error) {
+	data, err := session.get(ctx, "/issue_statuses.json", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -372,8 +1098,130 @@ func (session *Session) GetIssueStatuses() ([]IssueStatus, error) {
 	return statuses.IssueStatuses, nil
 }
 
+// HTTPError is returned when Redmine responds to a request with an error
+// status.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e HTTPError) Error() string {
+	return e.Status
+}
+
 // support /////////////////////////////////////////////////////////////
 
+// the number of items requested per page; it's the most Redmine allows
+const pageSize = 100
+
+// the maximum number of pages of a list that are requested at once
+const maxPageRequests = 4
+
+// getPaged returns all the items from a paged list endpoint, in order. key is
+// the name of the list in the response. The total count and the page size the
+// server actually uses are read from the first page, and the remaining pages
+// are then requested concurrently. Lists that change while they're being read
+// can't make this loop forever: only the pages counted from the first one are
+// requested, and a short page is taken to be the end of the list.
+func getPaged[T any](ctx context.Context, session *Session, path string, params map[string]string, key string) ([]T, error) {
+	getPage := func(ctx context.Context, offset, limit int) (items []T, total, pageLimit int, err error) {
+		pageParams := map[string]string{}
+		for name, value := range params {
+			pageParams[name] = value
+		}
+		pageParams["offset"] = strconv.Itoa(offset)
+		pageParams["limit"] = strconv.Itoa(limit)
+
+		var data []byte
+		if data, err = session.get(ctx, path, pageParams); err != nil {
+			return
+		}
+
+		var page map[string]json.RawMessage
+		if err = json.Unmarshal(data, &page); err != nil {
+			return
+		}
+		if err = json.Unmarshal(page[key], &items); err != nil {
+			return
+		}
+
+		// lists that aren't paged have no count or limit
+		total, pageLimit = len(items), len(items)
+		if raw, ok := page["total_count"]; ok {
+			err = json.Unmarshal(raw, &total)
+		}
+		if raw, ok := page["limit"]; ok && err == nil {
+			err = json.Unmarshal(raw, &pageLimit)
+		}
+		return
+	}
+
+	items, total, limit, err := getPage(ctx, 0, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 || limit <= 0 || total <= len(items) {
+		return items, nil
+	}
+
+	numPages := (total + limit - 1) / limit
+	pages := make([][]T, numPages)
+	pages[0] = items
+
+	// the first failure cancels the requests that are still running
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+
+	// a fixed number of workers take the remaining pages in turn
+	next := make(chan int, numPages-1)
+	for i := 1; i < numPages; i++ {
+		next <- i
+	}
+	close(next)
+
+	workers := maxPageRequests
+	if workers > numPages-1 {
+		workers = numPages - 1
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if ctx.Err() != nil {
+					return
+				}
+				var err error
+				if pages[i], _, _, err = getPage(ctx, i*limit, limit); err != nil {
+					once.Do(func() { firstErr = err })
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	var all []T
+	for _, page := range pages {
+		all = append(all, page...)
+		if len(page) < limit {
+			break
+		}
+	}
+
+	return all, nil
+}
+
 func toQueryString(params map[string]string) string {
 	values := url.Values{}
 	for key, value := range params {
@@ -382,12 +1230,60 @@ func toQueryString(params map[string]string) string {
 	return values.Encode()
 }
 
-func (session *Session) request(method string, requestURL string, body io.Reader) ([]byte, error) {
-	req, err := http.NewRequest(method, requestURL, body)
-	req.Header.Add("Content-Type", "application/json")
+// request sends a request to Redmine, retrying it according to Retries if it
+// fails in a way that might succeed later. Requests using non-idempotent
+// methods are only retried if the caller says they're safe to repeat. Nothing
+// is retried once ctx is done.
+func (session *Session) request(ctx context.Context, method, requestURL, contentType string, body []byte, retry bool) ([]byte, error) {
+	policy := Retries
+	retry = retry || isIdempotent(method)
+
+	for attempt := 0; ; attempt++ {
+		content, err := session.attempt(ctx, method, requestURL, contentType, body)
+		if err == nil || !retry || attempt >= policy.MaxRetries || ctx.Err() != nil || !isRetryable(err) {
+			return content, err
+		}
+
+		delay, ok := policy.delay(attempt, err)
+		if !ok {
+			dlog.Printf("not retrying %s %s: server asked for too long a wait", method, requestURL)
+			return content, err
+		}
+
+		dlog.Printf("retrying %s %s in %v after error: %v", method, requestURL, delay, err)
+		if err := sleep(ctx, delay); err != nil {
+			return content, err
+		}
+	}
+}
+
+func (session *Session) attempt(ctx context.Context, method, requestURL, contentType string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range session.headers {
+		req.Header.Set(name, value)
+	}
+	if contentType != "" {
+		req.Header.Add("Content-Type", contentType)
+	}
+
+	if session.gatewayUsername != "" {
+		if session.apiKey == "" {
+			return nil, clientConfigError{errGatewayNeedsKey}
+		}
+		dlog.Printf("using gateway auth: %s:*****", session.gatewayUsername)
+		req.SetBasicAuth(session.gatewayUsername, session.gatewayPassword)
+	}
 
 	if session.apiKey != "" {
-		dlog.Printf("using api key: %s", session.apiKey)
+		dlog.Printf("using api key")
 		req.Header.Add("X-Redmine-API-Key", session.apiKey)
 	} else {
 		dlog.Printf("using auth key: %s:*****", session.username)
@@ -405,14 +1301,106 @@ func (session *Session) request(method string, requestURL string, body io.Reader
 		return nil, err
 	}
 
+	if resp.StatusCode == http.StatusUnauthorized {
+		// Redmine answers a bad API key with its own realm; any other 401
+		// behind a gateway is the gateway refusing its own credentials, which
+		// logging in again won't fix
+		if session.gatewayUsername != "" && !isRedmineChallenge(resp.Header) {
+			return content, clientConfigError{errGatewayRejected}
+		}
+		if session.apiKey != "" && OnUnauthorized != nil {
+			OnUnauthorized(session.apiKey)
+		}
+	}
+
 	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
-		return content, fmt.Errorf(resp.Status)
+		return content, HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
 
 	return content, nil
 }
 
-func (session *Session) get(path string, params map[string]string) ([]byte, error) {
+// isRedmineChallenge returns true if a 401 response came from Redmine rather
+// than something in front of it.
+func isRedmineChallenge(header http.Header) bool {
+	for _, challenge := range header.Values("WWW-Authenticate") {
+		if strings.Contains(challenge, `realm="Redmine API"`) {
+			return true
+		}
+	}
+	return false
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// isRetryable returns true for errors that may go away if a request is
+// repeated: network failures and timeouts, rate limiting, and unavailable
+// gateways. Problems like bad certificates or malformed URLs aren't retried.
+func isRetryable(err error) bool {
+	var configErr clientConfigError
+	if errors.As(err, &configErr) || errors.Is(err, errKeyNotPinned) {
+		return false
+	}
+
+	if e, ok := err.(HTTPError); ok {
+		switch e.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	// a url.Error says it's a network error whatever caused it, so only the
+	// underlying error is checked
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	// connections that were refused, reset, or closed before the response
+	// was complete
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// parseRetryAfter reads a Retry-After header, which may be a number of
+// seconds or a date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(time.Now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func (session *Session) get(ctx context.Context, path string, params map[string]string) ([]byte, error) {
 	requestURL := session.url + path
 
 	if params != nil {
@@ -420,10 +1408,12 @@ func (session *Session) get(path string, params map[string]string) ([]byte, erro
 	}
 
 	dlog.Printf("GETing from URL: %s", requestURL)
-	return session.request("GET", requestURL, nil)
+	return session.request(ctx, "GET", requestURL, "application/json", nil, true)
 }
 
-func (session *Session) send(method, path string, data interface{}) ([]byte, error) {
+// send sends data to Redmine. If retry is true the request may be repeated
+// even if its method isn't idempotent.
+func (session *Session) send(ctx context.Context, method, path string, data interface{}, retry bool) ([]byte, error) {
 	requestURL := session.url + path
 
 	var body []byte
@@ -436,14 +1426,19 @@ func (session *Session) send(method, path string, data interface{}) ([]byte, err
 		}
 	}
 
-	dlog.Printf(method+"ing to URL %s: %s", requestURL, string(body))
-	return session.request(method, requestURL, bytes.NewBuffer(body))
+	dlog.Printf(method+"ing to URL %s", requestURL)
+	tlog.Printf("request body: %s", string(body))
+	return session.request(ctx, method, requestURL, "application/json", body, retry)
+}
+
+func (session *Session) post(ctx context.Context, path string, data interface{}) ([]byte, error) {
+	return session.send(ctx, "POST", path, data, false)
 }
 
-func (session *Session) post(path string, data interface{}) ([]byte, error) {
-	return session.send("POST", path, data)
+func (session *Session) put(ctx context.Context, path string, data interface{}) ([]byte, error) {
+	return session.send(ctx, "PUT", path, data, true)
 }
 
-func (session *Session) put(path string, data interface{}) ([]byte, error) {
-	return session.send("PUT", path, data)
+func (session *Session) delete(ctx context.Context, path string) ([]byte, error) {
+	return session.send(ctx, "DELETE", path, nil, true)
 }
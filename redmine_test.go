@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer starts a server that answers requests with handler, counting
+// them, and stubs out the delay between retries, recording the delays asked
+// for.
+func testServer(t *testing.T, handler http.HandlerFunc) (session Session, requests *int32, delays *[]time.Duration) {
+	requests = new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	delays = &[]time.Duration{}
+	savedSleep := sleep
+	savedRetries := Retries
+	sleep = func(ctx context.Context, d time.Duration) error {
+		*delays = append(*delays, d)
+		return ctx.Err()
+	}
+	Retries = RetryPolicy{
+		MaxRetries:    3,
+		BaseDelay:     100 * time.Millisecond,
+		MaxDelay:      time.Second,
+		MaxRetryAfter: 10 * time.Second,
+	}
+	t.Cleanup(func() {
+		sleep = savedSleep
+		Retries = savedRetries
+	})
+
+	return OpenSession(server.URL, "key"), requests, delays
+}
+
+func writeUser(w http.ResponseWriter) {
+	fmt.Fprint(w, `{"user":{"id":1,"login":"someone"}}`)
+}
+
+func TestRetryUnavailable(t *testing.T) {
+	var count int32
+	session, requests, delays := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeUser(w)
+	})
+
+	user, err := session.GetUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Login != "someone" {
+		t.Errorf("got user %q", user.Login)
+	}
+	if *requests != 2 {
+		t.Errorf("made %d requests, want 2", *requests)
+	}
+	if len(*delays) != 1 || (*delays)[0] > Retries.BaseDelay {
+		t.Errorf("waited %v, want one backoff delay", *delays)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var count int32
+	session, requests, delays := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		writeUser(w)
+	})
+
+	if _, err := session.GetUser(); err != nil {
+		t.Fatal(err)
+	}
+	if *requests != 2 {
+		t.Errorf("made %d requests, want 2", *requests)
+	}
+	if len(*delays) != 1 || (*delays)[0] != 2*time.Second {
+		t.Errorf("waited %v, want [2s]", *delays)
+	}
+}
+
+func TestRetryAfterTooLong(t *testing.T) {
+	session, requests, delays := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	_, err := session.GetUser()
+	if e, ok := err.(HTTPError); !ok || e.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("got error %v, want 429", err)
+	}
+	if *requests != 1 {
+		t.Errorf("made %d requests, want 1", *requests)
+	}
+	if len(*delays) != 0 {
+		t.Errorf("waited %v", *delays)
+	}
+}
+
+func TestNoRetryPost(t *testing.T) {
+	session, requests, _ := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	if _, err := session.post(context.Background(), "/issues.json", nil); err == nil {
+		t.Fatal("expected an error")
+	}
+	if *requests != 1 {
+		t.Errorf("made %d requests, want 1", *requests)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	session, requests, _ := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	if _, err := session.GetUser(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if want := int32(Retries.MaxRetries + 1); *requests != want {
+		t.Errorf("made %d requests, want %d", *requests, want)
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	session, requests, _ := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	// the context is cancelled while waiting to retry
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sleep = func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return ctx.Err()
+	}
+
+	if _, err := session.GetUserContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if *requests != 1 {
+		t.Errorf("made %d requests, want 1", *requests)
+	}
+}
+
+func TestSleepCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if err := sleep(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("sleep didn't stop when its context was cancelled")
+	}
+}
+
+func TestNoRetryCertificateError(t *testing.T) {
+	_, _, delays := testServer(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	// the default client doesn't trust the test server's certificate
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeUser(w)
+	}))
+	defer server.Close()
+
+	session := OpenSession(server.URL, "key")
+	if _, err := session.GetUser(); err == nil {
+		t.Fatal("expected a certificate error")
+	}
+	if len(*delays) != 0 {
+		t.Errorf("retried a certificate error after %v", *delays)
+	}
+}
+
+func TestNoRetryBadURL(t *testing.T) {
+	_, _, delays := testServer(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	session := OpenSession("http://[::1", "key")
+	if _, err := session.GetUser(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(*delays) != 0 {
+		t.Errorf("retried a malformed URL after %v", *delays)
+	}
+}
+
+func TestRetryRefusedConnection(t *testing.T) {
+	_, _, delays := testServer(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	// nothing is listening on a closed server's address
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	session := OpenSession(server.URL, "key")
+	server.Close()
+
+	if _, err := session.GetUser(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(*delays) != Retries.MaxRetries {
+		t.Errorf("waited %v, want %d retries", *delays, Retries.MaxRetries)
+	}
+}
+
+func TestGatewayRejection(t *testing.T) {
+	var rejected []string
+	savedOnUnauthorized := OnUnauthorized
+	OnUnauthorized = func(apiKey string) { rejected = append(rejected, apiKey) }
+	defer func() { OnUnauthorized = savedOnUnauthorized }()
+
+	realm := `Basic realm="gateway"`
+	session, _, _ := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", realm)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	session.SetGateway("gateway", "secret")
+
+	// the gateway refusing its own credentials says nothing about the API key
+	if _, err := session.GetUser(); !errors.Is(err, errGatewayRejected) {
+		t.Errorf("got error %v, want %v", err, errGatewayRejected)
+	}
+	if len(rejected) != 0 {
+		t.Errorf("API key was marked as rejected")
+	}
+
+	realm = `Basic realm="Redmine API"`
+	if _, err := session.GetUser(); err == nil {
+		t.Error("expected an error")
+	}
+	if len(rejected) != 1 || rejected[0] != "key" {
+		t.Errorf("rejected keys are %v, want [key]", rejected)
+	}
+}
+
+func TestAttachmentDownloadURL(t *testing.T) {
+	var path, apiKey string
+	session, _, _ := testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		apiKey = r.Header.Get("X-Redmine-API-Key")
+		fmt.Fprint(w, "content")
+	})
+
+	// the attachment's own URL points somewhere else, and mustn't get the key
+	content, err := session.GetAttachment(Attachment{ID: 12, ContentURL: "https://elsewhere.example.com/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Errorf("got content %q", content)
+	}
+	if path != "/attachments/download/12" || apiKey != "key" {
+		t.Errorf("requested %s with key %q", path, apiKey)
+	}
+}
+
+// pagedServer serves count projects from /projects.json, never more than
+// serverLimit at once. total gives the total_count to report for a request
+// at an offset, and respond can take over a request by returning true. The
+// most requests seen running at once is recorded in maxRunning.
+func pagedServer(t *testing.T, count, serverLimit int, total func(offset int) int, respond func(w http.ResponseWriter, r *http.Request, offset int) bool) (session Session, requests *int32, maxRunning *int32) {
+	var running int32
+	maxRunning = new(int32)
+	session, requests, _ = testServer(t, func(w http.ResponseWriter, r *http.Request) {
+		now := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(maxRunning)
+			if now <= max || atomic.CompareAndSwapInt32(maxRunning, max, now) {
+				break
+			}
+		}
+
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if respond != nil && respond(w, r, offset) {
+			return
+		}
+		if limit > serverLimit {
+			limit = serverLimit
+		}
+
+		var projects []Project
+		for id := offset; id < offset+limit && id < count; id++ {
+			projects = append(projects, Project{ID: id})
+		}
+		data, _ := json.Marshal(map[string]interface{}{
+			"projects":    projects,
+			"total_count": total(offset),
+			"offset":      offset,
+			"limit":       limit,
+		})
+		w.Write(data)
+	})
+	return
+}
+
+// checkProjects makes sure projects holds IDs 0 to count-1, in order.
+func checkProjects(t *testing.T, projects []Project, count int) {
+	t.Helper()
+	if len(projects) != count {
+		t.Fatalf("got %d projects, want %d", len(projects), count)
+	}
+	for i, project := range projects {
+		if project.ID != i {
+			t.Fatalf("project %d has ID %d", i, project.ID)
+		}
+	}
+}
+
+func TestPagedServerLimit(t *testing.T) {
+	// the server uses a smaller page than was asked for
+	const count = 257
+	session, requests, maxRunning := pagedServer(t, count, 25, func(int) int { return count }, nil)
+
+	projects, err := session.GetProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProjects(t, projects, count)
+	if atomic.LoadInt32(requests) != 11 {
+		t.Errorf("made %d requests, want 11", atomic.LoadInt32(requests))
+	}
+	if running := atomic.LoadInt32(maxRunning); running > maxPageRequests {
+		t.Errorf("made %d requests at once, want at most %d", running, maxPageRequests)
+	}
+}
+
+func TestPagedShortPages(t *testing.T) {
+	// the count includes items that the list doesn't return, so the last
+	// pages are short or empty
+	session, requests, _ := pagedServer(t, 150, pageSize, func(int) int { return 400 }, nil)
+
+	projects, err := session.GetProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProjects(t, projects, 150)
+	if atomic.LoadInt32(requests) != 4 {
+		t.Errorf("made %d requests, want 4", atomic.LoadInt32(requests))
+	}
+}
+
+func TestPagedCountChanges(t *testing.T) {
+	// items are added after the first page has been read; only the pages
+	// counted from the first one are requested
+	session, requests, _ := pagedServer(t, 1000, pageSize, func(offset int) int {
+		if offset == 0 {
+			return 250
+		}
+		return 1000
+	}, nil)
+
+	projects, err := session.GetProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProjects(t, projects, 300)
+	if atomic.LoadInt32(requests) != 3 {
+		t.Errorf("made %d requests, want 3", atomic.LoadInt32(requests))
+	}
+
+	// items are removed after the first page has been read
+	session, _, _ = pagedServer(t, 120, pageSize, func(offset int) int {
+		if offset == 0 {
+			return 450
+		}
+		return 120
+	}, nil)
+
+	if projects, err = session.GetProjects(); err != nil {
+		t.Fatal(err)
+	}
+	checkProjects(t, projects, 120)
+}
+
+func TestPagedCancelsOnError(t *testing.T) {
+	const count = 2000
+	session, requests, _ := pagedServer(t, count, pageSize, func(int) int { return count }, func(w http.ResponseWriter, r *http.Request, offset int) bool {
+		switch {
+		case offset == pageSize:
+			w.WriteHeader(http.StatusInternalServerError)
+			return true
+		case offset > pageSize:
+			// hold the other pages until their requests are cancelled
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+				t.Error("request wasn't cancelled")
+			}
+			return true
+		}
+		return false
+	})
+
+	_, err := session.GetProjects()
+	if e, ok := err.(HTTPError); !ok || e.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got error %v, want 500", err)
+	}
+
+	// the first page, and no more than one request from each worker
+	if made, max := atomic.LoadInt32(requests), int32(1+maxPageRequests); made > max {
+		t.Errorf("made %d requests, want at most %d", made, max)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import "log"
+
+// relation types in the order they're offered when creating a relation
+var relationTypes = []string{
+	RelationRelates,
+	RelationBlocks,
+	RelationPrecedes,
+	RelationDuplicates,
+	RelationCopiedTo,
+}
+
+// relationLabels describes each relation type from the point of view of the
+// issue the relation was created from, and then from the other issue
+var relationLabels = map[string][2]string{
+	RelationRelates:    {"Related to", "Related to"},
+	RelationBlocks:     {"Blocks", "Blocked by"},
+	RelationPrecedes:   {"Precedes", "Follows"},
+	RelationDuplicates: {"Duplicates", "Duplicated by"},
+	RelationCopiedTo:   {"Copied to", "Copied from"},
+}
+
+// describeRelation returns a label describing a relation from the point of
+// view of the given issue, and the ID of the issue on the other side.
+func describeRelation(issueID int, relation Relation) (label string, otherID int) {
+	labels, ok := relationLabels[relation.RelationType]
+	if !ok {
+		labels = [2]string{relation.RelationType, relation.RelationType}
+	}
+
+	if relation.IssueID == issueID {
+		return labels[0], relation.IssueToID
+	}
+	return labels[1], relation.IssueID
+}
+
+// getBlockers returns the IDs of the issues blocking an issue that aren't
+// known to be closed.
+func getBlockers(issue Issue) (ids []int) {
+	closed := getClosedStatusIDs()
+	for _, relation := range issue.Relations {
+		if relation.RelationType != RelationBlocks || relation.IssueToID != issue.ID {
+			continue
+		}
+		if blocker, ok := findIssue(relation.IssueID); ok && closed[blocker.Status.ID] {
+			continue
+		}
+		ids = append(ids, relation.IssueID)
+	}
+	return
+}
+
+// findIssue looks for an issue in the cached issues and related issues.
+func findIssue(id int) (issue Issue, ok bool) {
+	if idx := indexOfByID(issueList(cache.Issues), id); idx != -1 {
+		return cache.Issues[idx], true
+	}
+	if idx := indexOfByID(issueList(cache.RelatedIssues), id); idx != -1 {
+		return cache.RelatedIssues[idx], true
+	}
+	return
+}
+
+// getRelatedIssues loads issues that cached issues are related to but that
+// aren't themselves cached, so that relations can be shown with subjects and
+// blocked issues can be identified.
+func getRelatedIssues(session *Session) error {
+	known := map[int]bool{}
+	for _, issue := range cache.Issues {
+		known[issue.ID] = true
+	}
+
+	var toGet []int
+	for _, issue := range cache.Issues {
+		for _, relation := range issue.Relations {
+			_, otherID := describeRelation(issue.ID, relation)
+			if !known[otherID] {
+				known[otherID] = true
+				toGet = append(toGet, otherID)
+			}
+		}
+	}
+
+	// issues loaded for timesheets are kept for as long as time entries
+	// refer to them
+	logged := map[int]bool{}
+	for _, entry := range cache.TimeEntries {
+		logged[entry.Issue.ID] = true
+	}
+	var kept []Issue
+	for _, issue := range cache.RelatedIssues {
+		if logged[issue.ID] && !known[issue.ID] {
+			kept = append(kept, issue)
+		}
+	}
+
+	if len(toGet) == 0 {
+		cache.RelatedIssues = kept
+		return nil
+	}
+
+	log.Printf("Getting %d related issues...", len(toGet))
+	issues, err := session.GetIssuesByIDContext(commandCtx, toGet)
+	if err != nil {
+		return err
+	}
+
+	cache.RelatedIssues = append(issues, kept...)
+	return nil
+}
+
+type byBlocked []Issue
+
+func (b byBlocked) Len() int {
+	return len(b)
+}
+
+func (b byBlocked) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b byBlocked) Less(i, j int) bool {
+	return len(getBlockers(b[i])) == 0 && len(getBlockers(b[j])) > 0
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/jason0x43/go-alfred"
+)
+
+// ReleaseNotesCommand is a command
+type ReleaseNotesCommand struct{}
+
+// About returns information about a command
+func (c ReleaseNotesCommand) About() alfred.CommandDef {
+	return alfred.CommandDef{
+		Keyword:     releaseNotesKeyword,
+		Description: "Generate release notes for a project version",
+		IsEnabled:   isLoggedIn(),
+	}
+}
+
+// Items returns a list of filter items
+func (c ReleaseNotesCommand) Items(arg, data string) (items []alfred.Item, err error) {
+	var cfg releaseNotesCfg
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+			dlog.Printf("Invalid release notes config")
+		}
+	}
+
+	if err = checkRefresh(resProjects); err != nil {
+		return
+	}
+	defer func() { items = append(cacheStatusItems(arg), items...) }()
+
+	if cfg.Version != nil {
+		version := *cfg.Version
+		for _, format := range []string{notesMarkdown, notesText} {
+			for _, toFile := range []bool{false, true} {
+				var title string
+				if toFile {
+					title = fmt.Sprintf("Save %s to %s", format, getNotesDir())
+				} else {
+					title = fmt.Sprintf("Copy %s to the clipboard", format)
+				}
+
+				if !alfred.FuzzyMatches(title, arg) {
+					continue
+				}
+
+				items = append(items, alfred.Item{
+					Title:    title,
+					Subtitle: fmt.Sprintf("Release notes for %s %s", version.Project.Name, version.Name),
+					Arg: &alfred.ItemArg{
+						Keyword: releaseNotesKeyword,
+						Mode:    alfred.ModeDo,
+						Data: alfred.Stringify(&releaseNotesCfg{
+							ToGenerate: &releaseNotesRequest{
+								Version: version,
+								Format:  format,
+								ToFile:  toFile,
+							},
+						}),
+					},
+				})
+			}
+		}
+	} else if cfg.ProjectID != nil {
+		session := openSession()
+
+		var versions []Version
+		if versions, err = session.GetVersionsContext(commandCtx, *cfg.ProjectID); err != nil {
+			if isTimeout(err) {
+				err = errServerSlow
+			}
+			return
+		}
+
+		// Redmine lists versions oldest first; show the most recent first
+		for i := len(versions) - 1; i >= 0; i-- {
+			version := versions[i]
+			if !alfred.FuzzyMatches(version.Name, arg) {
+				continue
+			}
+
+			subTitle := version.Status
+			if version.DueDate != "" {
+				subTitle += ", due " + version.DueDate
+			}
+
+			items = append(items, alfred.Item{
+				UID:          fmt.Sprintf("redmineversion-%d", version.ID),
+				Title:        version.Name,
+				Subtitle:     subTitle,
+				Autocomplete: version.Name,
+				Arg: &alfred.ItemArg{
+					Keyword: releaseNotesKeyword,
+					Data:    alfred.Stringify(&releaseNotesCfg{Version: &version}),
+				},
+			})
+		}
+
+		if len(items) == 0 {
+			items = append(items, alfred.Item{Title: "No versions"})
+		}
+	} else {
+		for _, project := range cache.Projects {
+			if !isProjectOpen(project) || !projectMatches(project, arg) {
+				continue
+			}
+
+			pid := project.ID
+			items = append(items, alfred.Item{
+				UID:          fmt.Sprintf("redmineproject-%d", project.ID),
+				Title:        getProjectPath(project),
+				Subtitle:     "Choose a version of " + project.Name,
+				Autocomplete: project.Name,
+				Arg: &alfred.ItemArg{
+					Keyword: releaseNotesKeyword,
+					Data:    alfred.Stringify(&releaseNotesCfg{ProjectID: &pid}),
+				},
+			})
+		}
+	}
+
+	return
+}
+
+// Do runs the command
+func (c ReleaseNotesCommand) Do(data string) (out string, err error) {
+	defer startAction()()
+
+	var cfg releaseNotesCfg
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+			return "", fmt.Errorf("Invalid release notes config")
+		}
+	}
+
+	if cfg.ToGenerate == nil {
+		return
+	}
+
+	req := *cfg.ToGenerate
+
+	var notes string
+	if notes, err = generateReleaseNotes(req.Version, req.Format); err != nil {
+		return
+	}
+
+	if req.ToFile {
+		ext := ".txt"
+		if req.Format == notesMarkdown {
+			ext = ".md"
+		}
+		name := toFileName(req.Version.Project.Name+"-"+req.Version.Name) + ext
+		file := filepath.Join(getNotesDir(), name)
+
+		if err = ioutil.WriteFile(file, []byte(notes), 0644); err != nil {
+			return
+		}
+		out = "Saved release notes to " + file
+	} else {
+		cmd := exec.Command("pbcopy")
+		cmd.Stdin = strings.NewReader(notes)
+		if err = cmd.Run(); err != nil {
+			return
+		}
+		out = fmt.Sprintf("Copied release notes for %s", req.Version.Name)
+	}
+
+	return
+}
+
+// support -------------------------------------------------------------------
+
+const releaseNotesKeyword = "releasenotes"
+
+const (
+	notesMarkdown = "Markdown"
+	notesText     = "plain text"
+)
+
+const defaultMarkdownNotes = `# {{.Project}} {{.Version}}
+{{if .Date}}
+Released {{.Date}}
+{{end}}{{if .Description}}
+{{.Description}}
+{{end}}{{range .Groups}}
+## {{.Tracker}}
+
+{{range .Issues}}- [#{{.ID}}]({{.URL}}) {{.Subject}}
+{{end}}{{end}}`
+
+const defaultTextNotes = `{{.Project}} {{.Version}}
+{{if .Date}}Released {{.Date}}
+{{end}}{{if .Description}}
+{{.Description}}
+{{end}}{{range .Groups}}
+{{.Tracker}}:
+{{range .Issues}}  * #{{.ID}} {{.Subject}} <{{.URL}}>
+{{end}}{{end}}`
+
+// trackers listed here are shown first, in this order; any others follow
+// alphabetically
+var notesTrackerOrder = []string{"Feature", "Bug", "Support"}
+
+type releaseNotesCfg struct {
+	ProjectID  *int
+	Version    *Version
+	ToGenerate *releaseNotesRequest
+}
+
+type releaseNotesRequest struct {
+	Version Version
+	Format  string
+	ToFile  bool
+}
+
+type releaseNotes struct {
+	Project     string
+	Version     string
+	Description string
+	Date        string
+	Groups      []releaseNotesGroup
+}
+
+type releaseNotesGroup struct {
+	Tracker string
+	Issues  []releaseNotesIssue
+}
+
+type releaseNotesIssue struct {
+	ID      int
+	Subject string
+	URL     string
+}
+
+func generateReleaseNotes(version Version, format string) (string, error) {
+	session := openSession()
+
+	issues, err := session.GetVersionIssuesContext(commandCtx, version.ID)
+	if err != nil {
+		return "", err
+	}
+
+	notes := releaseNotes{
+		Project:     version.Project.Name,
+		Version:     version.Name,
+		Description: version.Description,
+		Date:        version.DueDate,
+	}
+
+	groups := map[string]*releaseNotesGroup{}
+	var trackers []string
+
+	for _, issue := range issues {
+		group, ok := groups[issue.Tracker.Name]
+		if !ok {
+			group = &releaseNotesGroup{Tracker: issue.Tracker.Name}
+			groups[issue.Tracker.Name] = group
+			trackers = append(trackers, issue.Tracker.Name)
+		}
+		group.Issues = append(group.Issues, releaseNotesIssue{
+			ID:      issue.ID,
+			Subject: issue.Subject,
+			URL:     session.IssueURL(issue),
+		})
+	}
+
+	sort.Sort(byTrackerOrder(trackers))
+	for _, tracker := range trackers {
+		notes.Groups = append(notes.Groups, *groups[tracker])
+	}
+
+	var tmpl *template.Template
+	if tmpl, err = getNotesTemplate(format); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, notes); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+func getNotesTemplate(format string) (*template.Template, error) {
+	text := defaultTextNotes
+	file := config.NotesText
+	if format == notesMarkdown {
+		text = defaultMarkdownNotes
+		file = config.NotesMarkdown
+	}
+
+	if file != "" {
+		data, err := ioutil.ReadFile(expandPath(file))
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+
+	return template.New("notes").Parse(text)
+}
+
+func getNotesDir() string {
+	if config.NotesDir != "" {
+		return expandPath(config.NotesDir)
+	}
+	return filepath.Join(os.Getenv("HOME"), "Desktop")
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^\w.-]+`)
+
+func toFileName(name string) string {
+	return strings.Trim(unsafeFileChars.ReplaceAllString(name, "_"), "_")
+}
+
+func trackerRank(name string) int {
+	for i, tracker := range notesTrackerOrder {
+		if tracker == name {
+			return i
+		}
+	}
+	return len(notesTrackerOrder)
+}
+
+type byTrackerOrder []string
+
+func (b byTrackerOrder) Len() int {
+	return len(b)
+}
+
+func (b byTrackerOrder) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b byTrackerOrder) Less(i, j int) bool {
+	ri, rj := trackerRank(b[i]), trackerRank(b[j])
+	if ri != rj {
+		return ri < rj
+	}
+	return b[i] < b[j]
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jason0x43/go-alfred"
+	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
+)
+
+// A cacheStore keeps a profile's cached data in a bbolt database. Each
+// resource has a bucket holding a JSON record for every item, keyed by ID, and
+// the order the server listed the items in is kept alongside them, since
+// projects and issue statuses are listed in a meaningful order.
+//
+// Each save is a single transaction that only rewrites the records that have
+// changed, so the store always holds a complete copy of the cache even when
+// several copies of the workflow use it at once. A copy of the workflow only
+// deletes records it loaded itself, so records added by another copy in the
+// meantime are kept.
+type cacheStore struct {
+	file string
+
+	// saved holds the JSON last read from or written to each record, by
+	// bucket and key
+	saved map[string]map[string][]byte
+}
+
+// storeVersion is the version of the store's layout and record formats. A
+// store with a different version is discarded and rebuilt from the server.
+const storeVersion = 1
+
+// storeLockTimeout is how long to wait for another copy of the workflow to
+// finish with the store.
+const storeLockTimeout = 2 * time.Second
+
+// store buckets
+const (
+	storeMeta     = "meta"
+	storeOrder    = "order"
+	storeIssues   = "issues"
+	storeRelated  = "related"
+	storeStatuses = "statuses"
+	storeProjects = "projects"
+	storeTime     = "time"
+	storeWiki     = "wiki"
+	storeDetails  = "details"
+)
+
+// storeResources are the buckets holding lists of records.
+var storeResources = []string{storeIssues, storeRelated, storeStatuses, storeProjects, storeTime, storeWiki, storeDetails}
+
+// keys in the meta bucket
+const (
+	storeVersionKey = "version"
+	storeMetaKey    = "meta"
+)
+
+// cacheMeta holds the parts of the cache that aren't lists of records.
+type cacheMeta struct {
+	Times             map[string]time.Time
+	FullSyncTime      time.Time
+	User              User
+	UnavailableIssues map[int]bool
+}
+
+// A storeRecord is an item in one of the store's lists.
+type storeRecord struct {
+	key   string
+	value interface{}
+}
+
+func openCacheStore(file string) *cacheStore {
+	return &cacheStore{file: file, saved: map[string]map[string][]byte{}}
+}
+
+// exists returns true if the store has been created.
+func (s *cacheStore) exists() bool {
+	_, err := os.Stat(s.file)
+	return err == nil
+}
+
+func (s *cacheStore) open(readOnly bool) (*bolt.DB, error) {
+	if !readOnly {
+		if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return bolt.Open(s.file, 0600, &bolt.Options{Timeout: storeLockTimeout, ReadOnly: readOnly})
+}
+
+// load reads the cached data from the store.
+func (s *cacheStore) load() (c cacheData, err error) {
+	s.saved = map[string]map[string][]byte{}
+	if !s.exists() {
+		return
+	}
+
+	var db *bolt.DB
+	if db, err = s.open(true); err != nil {
+		if err != berrors.ErrTimeout {
+			// a damaged store is rebuilt from the server
+			log.Println("Discarding unreadable cache store:", err)
+			err = os.Remove(s.file)
+		}
+		return
+	}
+
+	var version string
+	err = db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(storeMeta))
+		if meta == nil {
+			return nil
+		}
+		if version = string(meta.Get([]byte(storeVersionKey))); version != strconv.Itoa(storeVersion) {
+			return nil
+		}
+
+		if data := meta.Get([]byte(storeMetaKey)); data != nil {
+			s.remember(storeMeta, storeMetaKey, data)
+			if err := decodeRecord(&c, storeMeta, data); err != nil {
+				log.Println("Ignoring invalid cache metadata:", err)
+			}
+		}
+
+		orders := tx.Bucket([]byte(storeOrder))
+
+		for _, resource := range storeResources {
+			bucket := tx.Bucket([]byte(resource))
+			if bucket == nil {
+				continue
+			}
+
+			var order []string
+			if orders != nil {
+				if data := orders.Get([]byte(resource)); data != nil {
+					s.remember(storeOrder, resource, data)
+					json.Unmarshal(data, &order)
+				}
+			}
+
+			for _, key := range getOrderedKeys(bucket, order) {
+				data := bucket.Get([]byte(key))
+				// an invalid record is remembered so that the next save
+				// removes it
+				s.remember(resource, key, data)
+				if err := decodeRecord(&c, resource, data); err != nil {
+					log.Printf("Ignoring invalid cache record %s/%s: %v", resource, key, err)
+				}
+			}
+		}
+
+		return nil
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+
+	if version != strconv.Itoa(storeVersion) {
+		log.Printf("Discarding cache store with version %q", version)
+		s.saved = map[string]map[string][]byte{}
+		return cacheData{}, os.Remove(s.file)
+	}
+
+	// an empty wiki index that has been loaded is different from one that
+	// hasn't
+	if c.WikiPages == nil && !c.Times[resWiki].IsZero() {
+		c.WikiPages = []WikiPage{}
+	}
+
+	return
+}
+
+// remember records the saved JSON for a record, copying it out of the
+// database.
+func (s *cacheStore) remember(bucket, key string, data []byte) {
+	if s.saved[bucket] == nil {
+		s.saved[bucket] = map[string][]byte{}
+	}
+	s.saved[bucket][key] = append([]byte(nil), data...)
+}
+
+// getOrderedKeys lists the keys in a bucket in the saved order. Keys that
+// aren't in the order, which another copy of the workflow may have added,
+// come last in key order.
+func getOrderedKeys(bucket *bolt.Bucket, order []string) (keys []string) {
+	listed := map[string]bool{}
+	for _, key := range order {
+		if !listed[key] && bucket.Get([]byte(key)) != nil {
+			listed[key] = true
+			keys = append(keys, key)
+		}
+	}
+	bucket.ForEach(func(k, v []byte) error {
+		if !listed[string(k)] {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return
+}
+
+func decodeRecord(c *cacheData, resource string, data []byte) (err error) {
+	switch resource {
+	case storeMeta:
+		var meta cacheMeta
+		if err = json.Unmarshal(data, &meta); err == nil {
+			c.Times = meta.Times
+			c.FullSyncTime = meta.FullSyncTime
+			c.User = meta.User
+			c.UnavailableIssues = meta.UnavailableIssues
+		}
+	case storeIssues, storeRelated:
+		var issue Issue
+		if err = json.Unmarshal(data, &issue); err == nil {
+			if resource == storeIssues {
+				c.Issues = append(c.Issues, issue)
+			} else {
+				c.RelatedIssues = append(c.RelatedIssues, issue)
+			}
+		}
+	case storeStatuses:
+		var status IssueStatus
+		if err = json.Unmarshal(data, &status); err == nil {
+			c.IssueStatuses = append(c.IssueStatuses, status)
+		}
+	case storeProjects:
+		var project Project
+		if err = json.Unmarshal(data, &project); err == nil {
+			c.Projects = append(c.Projects, project)
+		}
+	case storeTime:
+		var entry TimeEntry
+		if err = json.Unmarshal(data, &entry); err == nil {
+			c.TimeEntries = append(c.TimeEntries, entry)
+		}
+	case storeWiki:
+		var page WikiPage
+		if err = json.Unmarshal(data, &page); err == nil {
+			c.WikiPages = append(c.WikiPages, page)
+		}
+	case storeDetails:
+		var details projectDetails
+		if err = json.Unmarshal(data, &details); err == nil {
+			c.ProjectDetails = append(c.ProjectDetails, details)
+		}
+	}
+	return
+}
+
+// save writes the records that have changed since the store was loaded or
+// last saved, and removes the ones that are no longer cached, in a single
+// transaction.
+func (s *cacheStore) save(c cacheData) error {
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// what's been saved is only updated once the transaction has succeeded
+	written := map[string]map[string][]byte{}
+	removed := map[string][]string{}
+
+	put := func(bucket *bolt.Bucket, name, key string, value interface{}) error {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if old, ok := s.saved[name][key]; ok && bytes.Equal(old, data) {
+			return nil
+		}
+		if written[name] == nil {
+			written[name] = map[string][]byte{}
+		}
+		written[name][key] = data
+		return bucket.Put([]byte(key), data)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(storeMeta))
+		if err != nil {
+			return err
+		}
+		if err := meta.Put([]byte(storeVersionKey), []byte(strconv.Itoa(storeVersion))); err != nil {
+			return err
+		}
+		if err := put(meta, storeMeta, storeMetaKey, cacheMeta{
+			Times:             c.Times,
+			FullSyncTime:      c.FullSyncTime,
+			User:              c.User,
+			UnavailableIssues: c.UnavailableIssues,
+		}); err != nil {
+			return err
+		}
+
+		orders, err := tx.CreateBucketIfNotExists([]byte(storeOrder))
+		if err != nil {
+			return err
+		}
+
+		for _, resource := range storeResources {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(resource))
+			if err != nil {
+				return err
+			}
+
+			records := getRecords(c, resource)
+			current := map[string]bool{}
+			order := make([]string, len(records))
+			for i, record := range records {
+				current[record.key] = true
+				order[i] = record.key
+				if err := put(bucket, resource, record.key, record.value); err != nil {
+					return err
+				}
+			}
+			if err := put(orders, storeOrder, resource, order); err != nil {
+				return err
+			}
+
+			for key := range s.saved[resource] {
+				if !current[key] {
+					if err := bucket.Delete([]byte(key)); err != nil {
+						return err
+					}
+					removed[resource] = append(removed[resource], key)
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, records := range written {
+		for key, data := range records {
+			s.remember(name, key, data)
+		}
+	}
+	for name, keys := range removed {
+		for _, key := range keys {
+			delete(s.saved[name], key)
+		}
+	}
+
+	return nil
+}
+
+// getRecords lists the cached items for a resource, in order, with the keys
+// they're stored under.
+func getRecords(c cacheData, resource string) (records []storeRecord) {
+	switch resource {
+	case storeIssues:
+		for _, issue := range c.Issues {
+			records = append(records, storeRecord{getRecordKey(issue.ID), issue})
+		}
+	case storeRelated:
+		for _, issue := range c.RelatedIssues {
+			records = append(records, storeRecord{getRecordKey(issue.ID), issue})
+		}
+	case storeStatuses:
+		for _, status := range c.IssueStatuses {
+			records = append(records, storeRecord{getRecordKey(status.ID), status})
+		}
+	case storeProjects:
+		for _, project := range c.Projects {
+			records = append(records, storeRecord{getRecordKey(project.ID), project})
+		}
+	case storeTime:
+		for _, entry := range c.TimeEntries {
+			records = append(records, storeRecord{getRecordKey(entry.ID), entry})
+		}
+	case storeWiki:
+		for _, page := range c.WikiPages {
+			// wiki pages have no ID, so they're keyed by project and title
+			hash := sha256.Sum256([]byte(page.Title))
+			records = append(records, storeRecord{fmt.Sprintf("%s-%x", getRecordKey(page.Project.ID), hash[:8]), page})
+		}
+	case storeDetails:
+		for _, details := range c.ProjectDetails {
+			records = append(records, storeRecord{getRecordKey(details.Project.ID), details})
+		}
+	}
+	return
+}
+
+// getRecordKey returns the key for an item's ID, padded so that keys sort in
+// ID order.
+func getRecordKey(id int) string {
+	return fmt.Sprintf("%010d", id)
+}
+
+// loadCache loads a profile's cache from its store. The cache.json file used
+// by older versions is moved into the store the first time.
+func loadCache(name string) {
+	localStore = openCacheStore(getStoreFile(name))
+	log.Println("Using cache store", localStore.file)
+
+	legacyFile := getCacheFile(name)
+	if _, err := os.Stat(legacyFile); err == nil {
+		migrateCache(legacyFile)
+	}
+
+	var err error
+	if cache, err = localStore.load(); err != nil {
+		log.Println("Error loading cache:", err)
+	}
+}
+
+// migrateCache copies the data from an old cache.json file into the active
+// store, unless the store already exists, and removes the file.
+func migrateCache(legacyFile string) {
+	if !localStore.exists() {
+		var old cacheData
+		if err := alfred.LoadJSON(legacyFile, &old); err != nil {
+			log.Println("Error loading old cache:", err)
+		} else if err := localStore.save(old); err != nil {
+			log.Println("Error migrating cache:", err)
+			return
+		} else {
+			log.Println("Migrated", legacyFile, "to cache store")
+		}
+	}
+
+	if err := os.Remove(legacyFile); err != nil {
+		log.Println("Error removing old cache:", err)
+	}
+}
+
+// saveCache saves the changes to the active profile's cache.
+func saveCache() error {
+	return localStore.save(cache)
+}
+
+func getStoreFile(name string) string {
+	if name == "" {
+		return filepath.Join(workflow.CacheDir(), "store.db")
+	}
+	return filepath.Join(workflow.CacheDir(), "store-"+toFileName(name)+".db")
+}
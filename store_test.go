@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jason0x43/go-alfred"
+	bolt "go.etcd.io/bbolt"
+)
+
+func testCache() cacheData {
+	return cacheData{
+		Times:        map[string]time.Time{resIssues: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		FullSyncTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		User:         User{ID: 7, Login: "someone"},
+		Issues:       []Issue{{ID: 20, Subject: "second"}, {ID: 10, Subject: "first"}},
+		// statuses and projects are kept in the server's order, not by ID
+		IssueStatuses: []IssueStatus{{ID: 3, Name: "New"}, {ID: 1, Name: "Closed"}},
+		Projects:      []Project{{ID: 9, Name: "Parent"}, {ID: 2, Name: "Child", Parent: IDentifier{ID: 9}}},
+		WikiPages:     []WikiPage{{Title: "Home"}},
+	}
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store.db")
+	want := testCache()
+
+	if err := openCacheStore(file).save(want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := openCacheStore(file).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %+v, want %+v", got, want)
+	}
+}
+
+func TestStoreSaveChanges(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store.db")
+	if err := openCacheStore(file).save(testCache()); err != nil {
+		t.Fatal(err)
+	}
+
+	store := openCacheStore(file)
+	c, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Issues = []Issue{{ID: 10, Subject: "changed"}}
+	if err := store.save(c); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := openCacheStore(file).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Issues, c.Issues) {
+		t.Errorf("loaded issues %+v, want %+v", got.Issues, c.Issues)
+	}
+}
+
+func TestStoreDiscardsOtherVersions(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store.db")
+	if err := openCacheStore(file).save(testCache()); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := bolt.Open(file, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(storeMeta)).Put([]byte(storeVersionKey), []byte(fmt.Sprint(storeVersion+1)))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := openCacheStore(file)
+	got, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, cacheData{}) {
+		t.Errorf("loaded %+v from a store with another version", got)
+	}
+	if store.exists() {
+		t.Error("store with another version wasn't removed")
+	}
+}
+
+func TestStoreConcurrentSaves(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "store.db")
+	if err := openCacheStore(file).save(cacheData{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// each copy of the workflow adds its own issue to the cache it loaded
+	const copies = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, copies)
+	for i := 1; i <= copies; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			store := openCacheStore(file)
+			c, err := store.load()
+			if err == nil {
+				c.Issues = append(c.Issues, Issue{ID: id})
+				err = store.save(c)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := openCacheStore(file).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Issues) != copies {
+		t.Errorf("loaded %d issues, want %d", len(got.Issues), copies)
+	}
+}
+
+func TestMigrateCache(t *testing.T) {
+	dir := t.TempDir()
+	legacyFile := filepath.Join(dir, "cache.json")
+	want := testCache()
+	if err := alfred.SaveJSON(legacyFile, &want); err != nil {
+		t.Fatal(err)
+	}
+
+	savedStore := localStore
+	defer func() { localStore = savedStore }()
+	localStore = openCacheStore(filepath.Join(dir, "store.db"))
+
+	migrateCache(legacyFile)
+
+	if _, err := os.Stat(legacyFile); !os.IsNotExist(err) {
+		t.Error("old cache file wasn't removed")
+	}
+	got, err := openCacheStore(localStore.file).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("migrated %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/jason0x43/go-alfred"
+)
+
+// getParentChain returns the subjects of an issue's ancestors, outermost
+// first. Ancestors that aren't cached are shown by number, and end the chain.
+func getParentChain(issue Issue) (chain []string) {
+	seen := map[int]bool{issue.ID: true}
+
+	for id := issue.Parent.ID; id != 0 && !seen[id]; {
+		seen[id] = true
+
+		parent, ok := findIssue(id)
+		if !ok {
+			chain = append([]string{"#" + strconv.Itoa(id)}, chain...)
+			break
+		}
+
+		chain = append([]string{parent.Subject}, chain...)
+		id = parent.Parent.ID
+	}
+
+	return
+}
+
+// getSubtasks returns the known direct subtasks of an issue.
+func getSubtasks(issue Issue) (subtasks []Issue) {
+	seen := map[int]bool{}
+
+	for _, list := range [][]Issue{cache.Issues, cache.RelatedIssues} {
+		for _, i := range list {
+			if i.Parent.ID == issue.ID && !seen[i.ID] {
+				seen[i.ID] = true
+				subtasks = append(subtasks, i)
+			}
+		}
+	}
+
+	for _, child := range issue.Children {
+		if seen[child.ID] {
+			continue
+		}
+		if i, ok := findIssue(child.ID); ok {
+			seen[child.ID] = true
+			subtasks = append(subtasks, i)
+		}
+	}
+
+	return
+}
+
+// getTotalSpentHours returns the time spent on an issue and all its subtasks.
+func getTotalSpentHours(issue Issue) float64 {
+	if issue.TotalSpentHours != 0 {
+		return issue.TotalSpentHours
+	}
+	return sumSpentHours(issue, map[int]bool{})
+}
+
+func sumSpentHours(issue Issue, seen map[int]bool) float64 {
+	seen[issue.ID] = true
+	total := issue.SpentHours
+	for _, subtask := range getSubtasks(issue) {
+		if !seen[subtask.ID] {
+			total += sumSpentHours(subtask, seen)
+		}
+	}
+	return total
+}
+
+// getTotalDoneRatio returns an issue's done ratio, computed from its subtasks
+// if it has any. Like Redmine, subtasks are weighted by their estimated hours
+// and closed subtasks count as done. If some of the subtasks aren't cached,
+// Redmine's own figure is used instead.
+func getTotalDoneRatio(issue Issue) int {
+	return int(doneRatio(issue, map[int]bool{}) + 0.5)
+}
+
+func doneRatio(issue Issue, seen map[int]bool) float64 {
+	seen[issue.ID] = true
+
+	var subtasks []Issue
+	if allSubtasksKnown(issue) {
+		for _, subtask := range getSubtasks(issue) {
+			if !seen[subtask.ID] {
+				subtasks = append(subtasks, subtask)
+			}
+		}
+	}
+
+	if len(subtasks) == 0 {
+		if getClosedStatusIDs()[issue.Status.ID] {
+			return 100
+		}
+		return float64(issue.DoneRatio)
+	}
+
+	// subtasks without an estimate are weighted by the average estimate
+	var estimated, count float64
+	for _, subtask := range subtasks {
+		if subtask.EstimatedHours > 0 {
+			estimated += subtask.EstimatedHours
+			count++
+		}
+	}
+	average := 1.0
+	if count > 0 {
+		average = estimated / count
+	}
+
+	var done, total float64
+	for _, subtask := range subtasks {
+		weight := subtask.EstimatedHours
+		if weight <= 0 {
+			weight = average
+		}
+		done += weight * doneRatio(subtask, seen)
+		total += weight
+	}
+
+	return done / total
+}
+
+// allSubtasksKnown returns true if every one of an issue's subtasks is cached.
+// Issues from lists don't say what their subtasks are, so an issue with cached
+// subtasks but no list of children can't be checked.
+func allSubtasksKnown(issue Issue) bool {
+	if len(issue.Children) == 0 {
+		return len(getSubtasks(issue)) == 0
+	}
+	for _, child := range issue.Children {
+		if _, ok := findIssue(child.ID); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// nestSubtasks reorders issues so that subtasks directly follow their parent,
+// and returns the nesting depth of each issue. Issues whose parent isn't in
+// the list are treated as top-level issues; the relative order of siblings is
+// preserved.
+func nestSubtasks(issues []Issue) (nested []Issue, depths []int) {
+	present := map[int]bool{}
+	for _, issue := range issues {
+		present[issue.ID] = true
+	}
+
+	children := map[int][]Issue{}
+	var roots []Issue
+	for _, issue := range issues {
+		if issue.Parent.ID != 0 && present[issue.Parent.ID] {
+			children[issue.Parent.ID] = append(children[issue.Parent.ID], issue)
+		} else {
+			roots = append(roots, issue)
+		}
+	}
+
+	added := map[int]bool{}
+	var add func(issue Issue, depth int)
+	add = func(issue Issue, depth int) {
+		if added[issue.ID] {
+			return
+		}
+		added[issue.ID] = true
+		nested = append(nested, issue)
+		depths = append(depths, depth)
+		for _, child := range children[issue.ID] {
+			add(child, depth+1)
+		}
+	}
+
+	for _, issue := range roots {
+		add(issue, 0)
+	}
+
+	// issues in a parent cycle have no root; list them at the top level
+	for _, issue := range issues {
+		add(issue, 0)
+	}
+
+	return
+}
+
+func indentSubtask(item alfred.Item, depth int) alfred.Item {
+	if depth > 0 {
+		item.Title = strings.Repeat("    ", depth-1) + "↳ " + item.Title
+	}
+	return item
+}
@@ -1,124 +1,560 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jason0x43/go-alfred"
 )
 
-func checkRefresh() error {
-	if time.Now().Sub(cache.Time).Minutes() <= 10.0 {
+// Cached resources. Each one is stamped when it's retrieved, and is refreshed
+// when it's older than its TTL and a command needs it.
+const (
+	resUser        = "user"
+	resStatuses    = "statuses"
+	resProjects    = "projects"
+	resTimeEntries = "time"
+	resIssues      = "issues"
+	resWiki        = "wiki"
+)
+
+// allResources are the resources refreshed by a sync; wiki pages are only
+// loaded by the wiki command.
+var allResources = []string{resUser, resStatuses, resProjects, resTimeEntries, resIssues}
+
+// default TTLs, in minutes
+var defaultTTLs = map[string]int{
+	resUser:        24 * 60,
+	resStatuses:    24 * 60,
+	resProjects:    60,
+	resTimeEntries: 10,
+	resIssues:      10,
+	resWiki:        10,
+}
+
+// getTTL returns how long a resource may be cached. The CacheTTLs option
+// overrides the defaults with a list like "issues=5,projects=120".
+func getTTL(resource string) time.Duration {
+	minutes := defaultTTLs[resource]
+
+	for _, setting := range strings.Split(config.CacheTTLs, ",") {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != resource {
+			continue
+		}
+		if value, err := strconv.Atoi(strings.TrimSpace(parts[1])); err == nil {
+			minutes = value
+		} else {
+			log.Printf("Invalid TTL for %s: %s", resource, parts[1])
+		}
+	}
+
+	return time.Duration(minutes) * time.Minute
+}
+
+// isStale returns true if a resource has never been retrieved or is older
+// than its TTL.
+func isStale(resource string) bool {
+	return time.Now().Sub(cache.Times[resource]) > getTTL(resource)
+}
+
+// checkRefresh makes sure the resources a command needs are reasonably
+// current. Resources that have never been retrieved are refreshed right away;
+// resources that are just stale are refreshed by a background process so that
+// the cached data can be shown without waiting.
+func checkRefresh(resources ...string) error {
+	var stale []string
+	missing := false
+
+	for _, resource := range resources {
+		if isStale(resource) {
+			stale = append(stale, resource)
+			if cache.Times[resource].IsZero() {
+				missing = true
+			}
+		}
+	}
+
+	if len(stale) == 0 {
 		return nil
 	}
 
-	log.Println("Refreshing cache...")
-	err := refresh()
+	if !missing {
+		startBackgroundRefresh(stale)
+		return nil
+	}
+
+	log.Println("Refreshing", strings.Join(stale, ", "))
+	err := refresh(false, stale...)
 	if err != nil {
 		log.Println("Error refreshing cache:", err)
+		if isExpired() {
+			return errSessionExpired
+		}
+
+		// stale data can still be shown; only fail if something the command
+		// needs couldn't be loaded at all
+		if failures, ok := err.(refreshError); ok {
+			for resource, ferr := range failures {
+				if cache.Times[resource].IsZero() {
+					if isTimeout(ferr) {
+						return errServerSlow
+					}
+					return err
+				}
+			}
+			if isTimeout(err) {
+				serverSlow = true
+			}
+			return nil
+		}
 	}
 	return err
 }
 
-func refresh() error {
-	dataChan := make(chan interface{})
-	errorChan := make(chan error)
+// the number of seconds a command waits for the server by default
+const defaultTimeout = 10
 
-	session := OpenSession(config.RedmineURL, config.APIKey)
-	numReqs := 0
+// commandCtx is used for all requests made by the current invocation of the
+// workflow, so that a slow server can't keep Alfred waiting indefinitely.
+var commandCtx = context.Background()
 
-	log.Println("Getting user...")
-	numReqs++
-	go func() {
-		user, err := session.GetUser()
-		if err != nil {
-			errorChan <- err
-		} else {
-			dataChan <- user
-		}
-	}()
+// serverSlow is set when the server didn't respond in time and the command is
+// showing cached data instead.
+var serverSlow bool
 
-	log.Println("Getting statuses...")
-	numReqs++
-	go func() {
-		statuses, err := session.GetIssueStatuses()
-		if err != nil {
-			errorChan <- err
-		} else {
-			dataChan <- statuses
+var errServerSlow = fmt.Errorf("The Redmine server is taking too long to respond")
+
+// getTimeout returns how long a command may wait for the server in total.
+func getTimeout() time.Duration {
+	if config.Timeout > 0 {
+		return time.Duration(config.Timeout) * time.Second
+	}
+	return defaultTimeout * time.Second
+}
+
+// actions, like uploads and bulk changes, may take this long; they aren't held
+// to the timeout for lists since they may reasonably take a while on a slow
+// connection
+const actionTimeout = 10 * time.Minute
+
+// startAction gives an action its own deadline in place of the command's. The
+// returned function releases it.
+func startAction() context.CancelFunc {
+	ctx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+	commandCtx = ctx
+	return cancel
+}
+
+// isTimeout returns true if err, or any of the errors in a refreshError, was
+// caused by a request's deadline passing.
+func isTimeout(err error) bool {
+	if failures, ok := err.(refreshError); ok {
+		for _, ferr := range failures {
+			if isTimeout(ferr) {
+				return true
+			}
 		}
-	}()
+		return false
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
 
-	log.Println("Getting projects...")
-	numReqs++
-	go func() {
-		projects, err := session.GetProjects()
-		if err != nil {
-			errorChan <- err
-		} else {
-			dataChan <- projects
+// refreshFlag is the command line flag that runs a background refresh
+const refreshFlag = "--refresh"
+
+// a refresh lock older than this was left by a refresh that didn't finish
+const refreshLockTimeout = 5 * time.Minute
+
+func getRefreshLockFile() string {
+	return localStore.file + ".lock"
+}
+
+// isRefreshing returns true if a background refresh of the active profile's
+// cache is running.
+func isRefreshing() bool {
+	info, err := os.Stat(getRefreshLockFile())
+	return err == nil && time.Now().Sub(info.ModTime()) < refreshLockTimeout
+}
+
+// startBackgroundRefresh starts a detached copy of the workflow to refresh
+// the cache, unless one is already running. The lock file is created here
+// and removed by the background process when it's done.
+func startBackgroundRefresh(resources []string) {
+	lockFile := getRefreshLockFile()
+
+	if info, err := os.Stat(lockFile); err == nil && time.Now().Sub(info.ModTime()) >= refreshLockTimeout {
+		log.Println("Removing stale refresh lock")
+		os.Remove(lockFile)
+	}
+
+	f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		if !os.IsExist(err) {
+			log.Println("Error creating refresh lock:", err)
 		}
-	}()
+		return
+	}
+	f.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+
+	cmd := exec.Command(exe, refreshFlag, config.Profile, strings.Join(resources, ","))
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		log.Println("Error starting background refresh:", err)
+		os.Remove(lockFile)
+		return
+	}
+
+	log.Println("Started background refresh, pid", cmd.Process.Pid)
+	cmd.Process.Release()
+}
+
+// runBackgroundRefresh refreshes resources in the active profile's cache and
+// releases the refresh lock.
+func runBackgroundRefresh(resources []string) {
+	defer os.Remove(getRefreshLockFile())
+
+	// nobody is waiting on a background refresh, but it mustn't outlive its
+	// lock
+	ctx, cancel := context.WithTimeout(context.Background(), refreshLockTimeout)
+	defer cancel()
+	commandCtx = ctx
+
+	log.Println("Refreshing in the background:", strings.Join(resources, ", "))
+	if err := refresh(false, resources...); err != nil {
+		log.Println("Error refreshing cache:", err)
+	}
+}
+
+// cacheStatusItems returns an item to show at the top of a list if the list
+// shows cached data, either because the server was too slow or because a
+// background refresh is running.
+func cacheStatusItems(arg string) []alfred.Item {
+	if serverSlow {
+		return []alfred.Item{slowItem(arg)}
+	}
+	if isRefreshing() {
+		return []alfred.Item{refreshingItem(arg)}
+	}
+	return nil
+}
+
+// slowItem tells the user that the server didn't respond in time. Actioning
+// it runs the query again.
+func slowItem(arg string) alfred.Item {
+	return alfred.Item{
+		Title:        "Server slow — showing cached data",
+		Subtitle:     "Action this item to try again",
+		Autocomplete: arg,
+	}
+}
+
+// refreshingItem tells the user that the list shows cached data that will be
+// replaced when the refresh finishes.
+func refreshingItem(arg string) alfred.Item {
+	return alfred.Item{
+		Title:        "Refreshing…",
+		Subtitle:     "Showing cached data; the list reloads when the refresh is done",
+		Autocomplete: arg,
+	}
+}
+
+// rerunInterval is how often, in seconds, Alfred runs a list again while a
+// background refresh is running
+const rerunInterval = 1
 
-	log.Println("Getting time entries...")
-	numReqs++
+// runWorkflow runs the workflow's commands. If a background refresh is running
+// when a list has been made, Alfred is asked to rerun the list so that it
+// reloads once the new cache lands. go-alfred can't ask for that itself, so
+// the rerun setting is added to the list it writes.
+func runWorkflow(commands []alfred.Command) {
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Println("Error capturing output:", err)
+		workflow.Run(commands)
+		return
+	}
+
+	output := make(chan []byte)
 	go func() {
-		timeEntries, err := session.GetTimeEntries(7)
-		if err != nil {
-			errorChan <- err
-		} else {
-			dataChan <- timeEntries
-		}
+		data, _ := ioutil.ReadAll(r)
+		output <- data
 	}()
 
-	log.Println("Getting issues...")
-	numReqs++
-	go func() {
-		issues, err := session.GetIssues()
-		if err != nil {
-			errorChan <- err
-		} else {
-			dataChan <- issues
+	os.Stdout = w
+	workflow.Run(commands)
+	os.Stdout = stdout
+	w.Close()
+
+	data := <-output
+	if isRefreshing() {
+		data = addRerun(data)
+	}
+	stdout.Write(data)
+}
+
+// addRerun adds the rerun setting to a list of items for Alfred. Other output
+// is returned unchanged.
+func addRerun(data []byte) []byte {
+	var list map[string]json.RawMessage
+	if err := json.Unmarshal(data, &list); err != nil || list["items"] == nil {
+		return data
+	}
+
+	list["rerun"] = json.RawMessage(strconv.Itoa(rerunInterval))
+	rerun, err := json.Marshal(list)
+	if err != nil {
+		return data
+	}
+	return rerun
+}
+
+var errSessionExpired = fmt.Errorf("Your Redmine session has expired — log in again")
+
+// Watched issues are normally refreshed incrementally, by getting only the
+// issues updated since the last refresh. Since that can't see issues that
+// were deleted, made private or unwatched, a full refresh is done
+// periodically too.
+const fullSyncInterval = 6 * time.Hour
+
+// issues that were updated while a refresh was running could have been missed
+// by it, as could issues whose update times were affected by clock skew
+const syncOverlap = 2 * time.Minute
+
+// issueUpdate holds the issues retrieved by a full or incremental refresh
+type issueUpdate struct {
+	issues []Issue
+	full   bool
+}
+
+// refresh updates resources in the cache from the server. If full is false,
+// only issues that have changed since the last refresh are retrieved.
+// Resources are retrieved concurrently; those that are retrieved successfully
+// are cached even if others fail, in which case the returned error names the
+// ones that failed.
+func refresh(full bool, resources ...string) error {
+	session := openSession()
+	started := time.Now()
+
+	if cache.Times[resIssues].IsZero() || time.Now().Sub(cache.FullSyncTime) > fullSyncInterval {
+		full = true
+	}
+
+	// the channel is big enough for every result so that no request is left
+	// blocked if the results aren't all read
+	results := make(chan refreshResult, len(resources))
+	numReqs := 0
+
+	for _, resource := range resources {
+		var get func() (interface{}, error)
+
+		switch resource {
+		case resUser:
+			log.Println("Getting user...")
+			get = func() (interface{}, error) { return session.GetUserContext(commandCtx) }
+		case resStatuses:
+			log.Println("Getting statuses...")
+			get = func() (interface{}, error) { return session.GetIssueStatusesContext(commandCtx) }
+		case resProjects:
+			log.Println("Getting projects...")
+			get = func() (interface{}, error) { return session.GetProjectsContext(commandCtx) }
+		case resTimeEntries:
+			log.Println("Getting time entries...")
+			get = func() (interface{}, error) { return session.GetTimeEntriesContext(commandCtx, 7) }
+		case resIssues:
+			if full {
+				log.Println("Getting issues...")
+				get = func() (interface{}, error) {
+					issues, err := session.GetIssuesContext(commandCtx)
+					return issueUpdate{issues: issues, full: true}, err
+				}
+			} else {
+				since := cache.Times[resIssues].Add(-syncOverlap)
+				log.Println("Getting issues updated since", since)
+				get = func() (interface{}, error) {
+					issues, err := session.GetIssuesUpdatedSinceContext(commandCtx, since)
+					return issueUpdate{issues: issues}, err
+				}
+			}
+		case resWiki:
+			log.Println("Getting wiki pages...")
+			projects, cached := cache.Projects, cache.WikiPages
+			get = func() (interface{}, error) {
+				pages, err := getWikiPages(&session, projects, cached)
+				return wikiUpdate{pages: pages}, err
+			}
+		default:
+			log.Println("Unknown resource", resource)
+			continue
 		}
-	}()
 
-	// wait for numReqs items to come in
+		numReqs++
+		go func(resource string, get func() (interface{}, error)) {
+			data, err := get()
+			results <- refreshResult{resource, data, err}
+		}(resource, get)
+	}
+
+	failures := refreshError{}
+	var update *issueUpdate
+	changed := false
+
 	for i := 0; i < numReqs; i++ {
-		select {
-		case data := <-dataChan:
-			switch value := data.(type) {
-			case User:
-				cache.User = value
-				log.Println("Got users")
-			case []Issue:
-				cache.Issues = value
-				log.Println("Got issues")
-			case []IssueStatus:
-				cache.IssueStatuses = value
-				log.Println("Got issue statuses")
-			case []Project:
-				cache.Projects = value
-				log.Println("Got projects")
-			case []TimeEntry:
-				cache.TimeEntries = value
-				log.Println("Got time entries")
+		result := <-results
+		if result.err != nil {
+			log.Printf("Error getting %s: %v", result.resource, result.err)
+			failures[result.resource] = result.err
+
+			// the wiki index keeps the pages it could get, but isn't fresh
+			if value, ok := result.data.(wikiUpdate); ok && value.pages != nil {
+				cache.WikiPages = value.pages
+				changed = true
 			}
-		case err := <-errorChan:
-			return err
+			continue
+		}
+		changed = true
+
+		switch value := result.data.(type) {
+		case User:
+			cache.User = value
+			log.Println("Got users")
+		case issueUpdate:
+			update = &value
+			log.Printf("Got %d issues", len(value.issues))
+		case []IssueStatus:
+			cache.IssueStatuses = value
+			log.Println("Got issue statuses")
+		case []Project:
+			cache.Projects = value
+			log.Println("Got projects")
+		case []TimeEntry:
+			cache.TimeEntries = value
+			log.Println("Got time entries")
+		case wikiUpdate:
+			cache.WikiPages = value.pages
+			log.Printf("Got %d wiki pages", len(value.pages))
 		}
+		stampResource(result.resource, started)
 	}
 
-	cache.Time = time.Now()
-	err := alfred.SaveJSON(cacheFile, &cache)
-	if err != nil {
-		log.Printf("Error writing cache: %s", err)
+	if update != nil {
+		// only the issues that were just fetched are known to be watched;
+		// the cache may also hold other issues
+		markWatched(update.issues)
+
+		if update.full {
+			cache.Issues = update.issues
+			cache.FullSyncTime = started
+
+			// issues that were unavailable may have been made visible again
+			cache.UnavailableIssues = nil
+		} else {
+			mergeIssues(update.issues)
+		}
+
+		if err := getRelatedIssues(&session); err != nil {
+			log.Println("Error getting related issues:", err)
+		}
 	}
 
+	if changed {
+		if err := saveCache(); err != nil {
+			log.Printf("Error writing cache: %s", err)
+		}
+	}
+
+	if len(failures) > 0 {
+		return failures
+	}
 	return nil
 }
 
+// wikiUpdate holds the wiki pages retrieved by a refresh, which may be
+// partial if some projects' indexes couldn't be loaded
+type wikiUpdate struct {
+	pages []WikiPage
+}
+
+type refreshResult struct {
+	resource string
+	data     interface{}
+	err      error
+}
+
+// refreshError holds the errors for the resources that couldn't be refreshed.
+type refreshError map[string]error
+
+func (e refreshError) Error() string {
+	var names []string
+	for resource := range e {
+		names = append(names, resource)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, resource := range names {
+		parts = append(parts, fmt.Sprintf("%s (%v)", resource, e[resource]))
+	}
+	return "Unable to refresh " + strings.Join(parts, ", ")
+}
+
+// stampResource records when a resource was retrieved.
+func stampResource(resource string, t time.Time) {
+	if cache.Times == nil {
+		cache.Times = map[string]time.Time{}
+	}
+	cache.Times[resource] = t
+}
+
+// mergeIssues updates cached issues with newer versions of them, and adds
+// issues that aren't cached yet.
+func mergeIssues(issues []Issue) {
+	for _, issue := range issues {
+		if idx := indexOfByID(issueList(cache.Issues), issue.ID); idx != -1 {
+			cache.Issues[idx] = issue
+		} else {
+			cache.Issues = append(cache.Issues, issue)
+		}
+	}
+}
+
+// markWatched records the current user as a watcher of issues from the watched
+// issues list; Redmine only includes watchers when fetching a single issue.
+func markWatched(issues []Issue) {
+	for i := range issues {
+		if !isWatching(issues[i]) {
+			issues[i].Watchers = append(issues[i].Watchers, IDentifier{ID: cache.User.ID, Name: cache.User.Login})
+		}
+	}
+}
+
+func isWatching(issue Issue) bool {
+	for _, watcher := range issue.Watchers {
+		if watcher.ID == cache.User.ID {
+			return true
+		}
+	}
+	return false
+}
+
 func indexOfByName(list listInterface, name string) int {
 	name = strings.ToLower(name)
 	for i := 0; i < list.Len(); i++ {
@@ -190,6 +626,33 @@ func getClosedStatusIDs() map[int]bool {
 	return closed
 }
 
+func toHumanFileSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size) / 1024
+	for _, unit := range []string{"KB", "MB", "GB"} {
+		if value < 1024 || unit == "GB" {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+		value /= 1024
+	}
+	return ""
+}
+
+// expandPath cleans up a path typed or pasted into Alfred, removing quotes
+// and shell escapes and expanding a leading ~
+func expandPath(path string) string {
+	path = strings.TrimSpace(path)
+	path = strings.Trim(path, `"'`)
+	path = strings.Replace(path, `\ `, " ", -1)
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		path = filepath.Join(os.Getenv("HOME"), path[1:])
+	}
+	return path
+}
+
 func toIsoDateString(date time.Time) string {
 	return fmt.Sprintf("%d-%02d-%02d", date.Year(), date.Month(), date.Day())
 }
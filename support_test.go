@@ -0,0 +1,24 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAddRerun(t *testing.T) {
+	var list map[string]interface{}
+	if err := json.Unmarshal(addRerun([]byte(`{"items":[{"title":"one"}]}`)), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list["rerun"] != float64(rerunInterval) {
+		t.Errorf("rerun is %v, want %v", list["rerun"], rerunInterval)
+	}
+	if items, _ := list["items"].([]interface{}); len(items) != 1 {
+		t.Errorf("items are %v", list["items"])
+	}
+
+	// the output of actions isn't a list
+	if out := string(addRerun([]byte("Updated options"))); out != "Updated options" {
+		t.Errorf("action output changed to %q", out)
+	}
+}
@@ -10,13 +10,18 @@ func (c SyncCommand) About() alfred.CommandDef {
 	return alfred.CommandDef{
 		Keyword:     "sync",
 		Description: "Sync with your Redmine server",
-		IsEnabled:   config.APIKey != "",
+		IsEnabled:   isLoggedIn(),
 	}
 }
 
 // Items returns a list of filter items
 func (c SyncCommand) Items(arg, data string) (items []alfred.Item, err error) {
-	if err = refresh(); err != nil {
+	if err = refresh(true, allResources...); err != nil {
+		if isExpired() {
+			err = errSessionExpired
+		} else if isTimeout(err) {
+			err = errServerSlow
+		}
 		return
 	}
 	items = append(items, alfred.Item{Title: "Synchronized!"})
@@ -21,7 +21,7 @@ func (c TimesheetCommand) About() alfred.CommandDef {
 	return alfred.CommandDef{
 		Keyword:     timesheetKeyword,
 		Description: "Generate a timesheet",
-		IsEnabled:   config.APIKey != "" && cache.User.ID != 0,
+		IsEnabled:   isLoggedIn() && cache.User.ID != 0,
 	}
 }
 
@@ -37,6 +37,11 @@ func (c TimesheetCommand) Items(arg, data string) (items []alfred.Item, err erro
 	var span span
 
 	if cfg.Span != nil {
+		if err = checkRefresh(resUser, resProjects, resTimeEntries); err != nil {
+			return
+		}
+		defer func() { items = append(cacheStatusItems(arg), items...) }()
+
 		span = *cfg.Span
 		if items, err = createTimesheetItems(arg, span); err != nil {
 			return
@@ -92,6 +97,7 @@ type timesheetCfg struct {
 
 type timesheetIssue struct {
 	total float64
+	id    int
 	name  string
 	issue *Issue
 }
@@ -152,10 +158,19 @@ func generateTimesheet(span span) (timesheet timesheet, err error) {
 	log.Printf("generating timesheet from %s to %s", span.From, span.To)
 
 	projects := map[int]*timesheetProject{}
-	issues := map[int]*timesheetIssue{}
 
-	if err = getMissingIssues(); err != nil {
-		return
+	// issues are keyed by project and issue ID, since an issue's time may be
+	// logged in more than one project if it's been moved, and time logged
+	// without an issue has an issue ID of 0
+	issues := map[[2]int]*timesheetIssue{}
+
+	if err := getMissingIssues(); err != nil {
+		// the timesheet can still be shown, with the issues that couldn't be
+		// loaded marked as unavailable
+		log.Println("Error getting missing issues:", err)
+		if isTimeout(err) {
+			serverSlow = true
+		}
 	}
 
 	for i := range cache.TimeEntries {
@@ -177,20 +192,33 @@ func generateTimesheet(span span) (timesheet timesheet, err error) {
 					log.Printf("Missing project %v", entry.Project.ID)
 				} else {
 					project.project = &cache.Projects[idx]
+					if project.name == "" {
+						project.name = project.project.Name
+					}
+				}
+
+				if project.name == "" {
+					project.name = fmt.Sprintf("Project %d", entry.Project.ID)
 				}
 
 				projects[entry.Project.ID] = project
 				timesheet.projects = append(timesheet.projects, project)
 			}
 
-			if issue, ok = issues[entry.Issue.ID]; !ok {
-				idx := indexOfByID(issueList(cache.Issues), entry.Issue.ID)
-				ri := cache.Issues[idx]
-				issue = &timesheetIssue{
-					name:  ri.Subject,
-					issue: &ri,
+			key := [2]int{entry.Project.ID, entry.Issue.ID}
+			if issue, ok = issues[key]; !ok {
+				issue = &timesheetIssue{id: entry.Issue.ID}
+
+				if entry.Issue.ID == 0 {
+					issue.name = "(project time)"
+				} else if ri, found := findIssue(entry.Issue.ID); found {
+					issue.name = fmt.Sprintf("#%d %s", ri.ID, ri.Subject)
+					issue.issue = &ri
+				} else {
+					issue.name = fmt.Sprintf("#%d (unavailable)", entry.Issue.ID)
 				}
-				issues[entry.Issue.ID] = issue
+
+				issues[key] = issue
 				project.issues = append(project.issues, issue)
 			}
 
@@ -220,58 +248,62 @@ func getDateLayout(s string) string {
 	return ""
 }
 
+// getMissingIssues loads the issues that time entries were logged against
+// but that aren't cached. Issues are requested in batches; those that can't be
+// seen, because they've been deleted or made private, are remembered so that
+// they aren't requested again until the next full sync.
 func getMissingIssues() error {
-	issueChan := make(chan Issue)
-	errorChan := make(chan error)
-
-	var ids []int
+	known := map[int]bool{}
 	for _, issue := range cache.Issues {
-		ids = append(ids, issue.ID)
+		known[issue.ID] = true
+	}
+	for _, issue := range cache.RelatedIssues {
+		known[issue.ID] = true
+	}
+	for id := range cache.UnavailableIssues {
+		known[id] = true
 	}
 
 	var toGet []int
 	for _, entry := range cache.TimeEntries {
-		found := false
-		for _, id := range ids {
-			if entry.Issue.ID == id {
-				found = true
-				break
-			}
-		}
-		if !found {
-			toGet = append(toGet, entry.Issue.ID)
+		if id := entry.Issue.ID; id != 0 && !known[id] {
+			known[id] = true
+			toGet = append(toGet, id)
 		}
 	}
 
-	session := OpenSession(config.RedmineURL, config.APIKey)
+	if len(toGet) == 0 {
+		return nil
+	}
 
-	for _, id := range toGet {
-		go func(id int) {
-			ri, err := session.GetIssue(id)
-			if err != nil {
-				errorChan <- err
-			} else {
-				issueChan <- ri
-			}
-		}(id)
+	log.Printf("Getting %d missing issues...", len(toGet))
+	session := openSession()
+	issues, err := session.GetIssuesByIDContext(commandCtx, toGet)
+
+	// the issues aren't watched, so they're kept with the related issues
+	// rather than in the watched list
+	found := map[int]bool{}
+	for _, issue := range issues {
+		found[issue.ID] = true
+		cache.RelatedIssues = append(cache.RelatedIssues, issue)
 	}
 
-	for _ = range toGet {
-		select {
-		case issue := <-issueChan:
-			cache.Issues = append(cache.Issues, issue)
-			log.Println("appended issue", issue.ID)
-		case err := <-errorChan:
-			return err
+	for _, id := range toGet {
+		// if loading failed part way, the issues that weren't returned may
+		// just not have been asked for yet
+		if !found[id] && err == nil {
+			log.Printf("Issue %d is unavailable", id)
+			if cache.UnavailableIssues == nil {
+				cache.UnavailableIssues = map[int]bool{}
+			}
+			cache.UnavailableIssues[id] = true
 		}
 	}
 
-	err := alfred.SaveJSON(cacheFile, &cache)
-	if err != nil {
+	if err := saveCache(); err != nil {
 		log.Println("Error saving cache:", err)
 	}
-
-	return nil
+	return err
 }
 
 // expand fills in the start and end times for a span
@@ -344,6 +376,8 @@ func createTimesheetItems(arg string, span span) (items []alfred.Item, err error
 		total := 0.0
 		totalName := ""
 
+		var selected *timesheetProject
+
 		for _, project := range timesheet.projects {
 			if arg == "" || alfred.FuzzyMatches(project.name, arg) {
 				items = append(items, alfred.Item{
@@ -353,6 +387,9 @@ func createTimesheetItems(arg string, span span) (items []alfred.Item, err error
 				})
 				total += project.total
 			}
+			if strings.EqualFold(project.name, arg) {
+				selected = project
+			}
 		}
 
 		if arg == "" {
@@ -361,6 +398,31 @@ func createTimesheetItems(arg string, span span) (items []alfred.Item, err error
 
 		sort.Sort(alfred.ByTitle(items))
 
+		// a project that's been picked from the list is broken down by issue
+		if selected != nil {
+			session := openSession()
+			for _, issue := range selected.issues {
+				item := alfred.Item{
+					Title:    issue.name,
+					Subtitle: fmt.Sprintf("%.2f", issue.total),
+				}
+				var url string
+				if issue.issue != nil {
+					url = session.IssueURL(*issue.issue)
+				} else if issue.id == 0 && selected.project != nil {
+					url = getProjectURL(selected.id)
+				}
+				if url != "" {
+					item.Arg = &alfred.ItemArg{
+						Keyword: timesheetKeyword,
+						Mode:    alfred.ModeDo,
+						Data:    alfred.Stringify(&timesheetCfg{ToOpen: url}),
+					}
+				}
+				items = append(items, item)
+			}
+		}
+
 		if totalName != "" {
 			item := alfred.Item{
 				Title:        fmt.Sprintf("Total hours %s: %.2f", totalName, total),
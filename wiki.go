@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jason0x43/go-alfred"
+)
+
+// WikiCommand is a command
+type WikiCommand struct{}
+
+// About returns information about a command
+func (c WikiCommand) About() alfred.CommandDef {
+	return alfred.CommandDef{
+		Keyword:     wikiKeyword,
+		Description: "Search your projects' wikis",
+		IsEnabled:   isLoggedIn(),
+	}
+}
+
+// Items returns a list of filter items
+func (c WikiCommand) Items(arg, data string) (items []alfred.Item, err error) {
+	if err = checkRefresh(resProjects); err != nil {
+		return
+	}
+	defer func() { items = append(cacheStatusItems(arg), items...) }()
+
+	if err = checkRefresh(resWiki); err != nil {
+		return
+	}
+
+	for i := range cache.WikiPages {
+		page := cache.WikiPages[i]
+		title := strings.Replace(page.Title, "_", " ", -1)
+
+		if !alfred.FuzzyMatches(title, arg) && !alfred.FuzzyMatches(page.Project.Name+" "+title, arg) {
+			continue
+		}
+
+		subTitle := fmt.Sprintf("[%s]", page.Project.Name)
+		if page.Parent.Title != "" {
+			subTitle += " " + strings.Replace(page.Parent.Title, "_", " ", -1) + " ›"
+		}
+		if updated, err := time.Parse(time.RFC3339, page.UpdatedOn); err == nil {
+			subTitle += " updated " + toHumanDateString(updated.Local())
+		}
+
+		item := alfred.Item{
+			UID:          fmt.Sprintf("redminewiki-%d-%s", page.Project.ID, page.Title),
+			Title:        title,
+			Subtitle:     subTitle,
+			Autocomplete: title,
+			Arg: &alfred.ItemArg{
+				Keyword: wikiKeyword,
+				Mode:    alfred.ModeDo,
+				Data:    alfred.Stringify(&wikiCfg{ToOpen: getWikiPageURL(page)}),
+			},
+		}
+
+		item.AddMod(alfred.ModCmd, alfred.ItemMod{
+			Subtitle: "Preview this page with Quick Look",
+			Arg: &alfred.ItemArg{
+				Keyword: wikiKeyword,
+				Mode:    alfred.ModeDo,
+				Data:    alfred.Stringify(&wikiCfg{ToPreview: &page}),
+			},
+		})
+
+		items = append(items, item)
+	}
+
+	if len(items) == 0 {
+		items = append(items, alfred.Item{Title: "No wiki pages"})
+	}
+
+	return
+}
+
+// Do runs the command
+func (c WikiCommand) Do(data string) (out string, err error) {
+	defer startAction()()
+
+	var cfg wikiCfg
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+			return "", fmt.Errorf("Invalid wiki config")
+		}
+	}
+
+	if cfg.ToOpen != "" {
+		err = exec.Command("open", cfg.ToOpen).Run()
+	}
+
+	if cfg.ToPreview != nil {
+		session := openSession()
+
+		var page WikiPage
+		if page, err = session.GetWikiPageContext(commandCtx, cfg.ToPreview.Project.ID, cfg.ToPreview.Title); err != nil {
+			return
+		}
+		page.Project.Name = cfg.ToPreview.Project.Name
+
+		dir := filepath.Join(workflow.CacheDir(), "wiki")
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return
+		}
+
+		file := filepath.Join(dir, toFileName(fmt.Sprintf("%d-%s", page.Project.ID, page.Title))+".html")
+		if err = ioutil.WriteFile(file, []byte(renderWikiPage(page, config.WikiFormat)), 0644); err != nil {
+			return
+		}
+
+		// qlmanage stays running until the preview is closed, so don't wait
+		err = exec.Command("qlmanage", "-p", file).Start()
+	}
+
+	return
+}
+
+// support -------------------------------------------------------------------
+
+const wikiKeyword = "wiki"
+
+// the maximum number of wiki indexes that will be requested at once
+const maxWikiRequests = 4
+
+type wikiCfg struct {
+	ToOpen    string
+	ToPreview *WikiPage
+}
+
+// getWikiPages gets the wiki indexes of projects. Projects whose index
+// couldn't be loaded keep their pages from cached, and the error for them is
+// returned along with the pages.
+func getWikiPages(session *Session, projects []Project, cached []WikiPage) ([]WikiPage, error) {
+	type wikiResult struct {
+		project Project
+		pages   []WikiPage
+		err     error
+	}
+
+	results := make(chan wikiResult, len(projects))
+	limit := make(chan bool, maxWikiRequests)
+
+	for _, project := range projects {
+		go func(project Project) {
+			limit <- true
+			pages, err := session.GetWikiPagesContext(commandCtx, project.ID)
+			<-limit
+			results <- wikiResult{project, pages, err}
+		}(project)
+	}
+
+	pages := []WikiPage{}
+	var lastErr error
+
+	for range projects {
+		result := <-results
+		if isNoWiki(result.err) {
+			dlog.Printf("No wiki for project %s", result.project.Name)
+			continue
+		}
+		if result.err != nil {
+			log.Printf("Error getting wiki for project %s: %v", result.project.Name, result.err)
+			// a timeout is reported over other errors so that the list can
+			// say the server was slow
+			if lastErr == nil || !isTimeout(lastErr) {
+				lastErr = result.err
+			}
+			for _, page := range cached {
+				if page.Project.ID == result.project.ID {
+					pages = append(pages, page)
+				}
+			}
+			continue
+		}
+
+		for _, page := range result.pages {
+			page.Project.Name = result.project.Name
+			pages = append(pages, page)
+		}
+	}
+
+	sort.Sort(byProjectAndTitle(pages))
+	return pages, lastErr
+}
+
+// isNoWiki returns true for the errors Redmine gives when a project doesn't
+// have a wiki, or has one the user can't see.
+func isNoWiki(err error) bool {
+	if e, ok := err.(HTTPError); ok {
+		return e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+func getWikiPageURL(page WikiPage) string {
+	return fmt.Sprintf("%s/projects/%s/wiki/%s", config.RedmineURL, getProjectSlug(page.Project.ID), url.PathEscape(page.Title))
+}
+
+type byProjectAndTitle []WikiPage
+
+func (b byProjectAndTitle) Len() int {
+	return len(b)
+}
+
+func (b byProjectAndTitle) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b byProjectAndTitle) Less(i, j int) bool {
+	if b[i].Project.Name != b[j].Project.Name {
+		return b[i].Project.Name < b[j].Project.Name
+	}
+	return b[i].Title < b[j].Title
+}